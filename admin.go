@@ -0,0 +1,101 @@
+package echoserver
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type AdminConfig struct {
+	// Address of the internal listener for monitoring, health checks, pprof
+	// and runtime info. They are served on the public listener when empty.
+	Address      string
+	DisablePprof bool
+}
+
+type runtimeInfo struct {
+	Service      string    `json:"service"`
+	GoVersion    string    `json:"go_version"`
+	Module       string    `json:"module,omitempty"`
+	Version      string    `json:"version,omitempty"`
+	StartedAt    time.Time `json:"started_at"`
+	Uptime       string    `json:"uptime"`
+	NumCPU       int       `json:"num_cpu"`
+	NumGoroutine int       `json:"num_goroutine"`
+	HeapAlloc    uint64    `json:"heap_alloc"`
+	HeapSys      uint64    `json:"heap_sys"`
+	NumGC        uint32    `json:"num_gc"`
+}
+
+func newAdminServer() *echo.Echo {
+	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+	return e
+}
+
+// monitoringEngine returns the echo instance internal endpoints are mounted on.
+func (es *echoServer) monitoringEngine() *echo.Echo {
+	if es.admin != nil {
+		return es.admin
+	}
+	return es.server
+}
+
+func (es *echoServer) mountAdmin(e *echo.Echo) {
+	e.GET("/runtime", es.runtimeHandler)
+	if es.live.Load().Admin.DisablePprof {
+		return
+	}
+	e.GET("/debug/pprof/cmdline", echo.WrapHandler(http.HandlerFunc(pprof.Cmdline)))
+	e.GET("/debug/pprof/profile", echo.WrapHandler(http.HandlerFunc(pprof.Profile)))
+	e.GET("/debug/pprof/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+	e.POST("/debug/pprof/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+	e.GET("/debug/pprof/trace", echo.WrapHandler(http.HandlerFunc(pprof.Trace)))
+	e.GET("/debug/pprof/*", echo.WrapHandler(http.HandlerFunc(pprof.Index)))
+}
+
+func (es *echoServer) runtimeHandler(c echo.Context) error {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	info := runtimeInfo{
+		Service:      es.live.Load().ServiceName,
+		GoVersion:    runtime.Version(),
+		StartedAt:    es.startedAt,
+		Uptime:       time.Since(es.startedAt).Round(time.Second).String(),
+		NumCPU:       runtime.NumCPU(),
+		NumGoroutine: runtime.NumGoroutine(),
+		HeapAlloc:    mem.HeapAlloc,
+		HeapSys:      mem.HeapSys,
+		NumGC:        mem.NumGC,
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		info.Module = bi.Main.Path
+		info.Version = bi.Main.Version
+	}
+	return c.JSON(http.StatusOK, info)
+}
+
+// startAdmin binds the admin listener and serves it in the background. A
+// failed bind is returned, so the server does not run without its internal
+// endpoints.
+func (es *echoServer) startAdmin() error {
+	ln, err := net.Listen("tcp", es.live.Load().Admin.Address)
+	if err != nil {
+		return fmt.Errorf("admin listener: %w", err)
+	}
+	es.admin.Listener = ln
+	go func() {
+		err := es.admin.Start(ln.Addr().String())
+		if err != nil && err != http.ErrServerClosed {
+			es.reloader.logf("admin listener stopped: %v", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,459 @@
+package echoserver
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aliworkshop/gateway/v2"
+	"github.com/labstack/echo/v4"
+)
+
+const cacheStoreKey = "_echoserver.cache_store"
+const cacheTagsKey = "_echoserver.cache_tags"
+
+// CacheEntry is a cached response.
+type CacheEntry struct {
+	Status   int
+	Header   http.Header
+	Body     []byte
+	Tags     []string
+	StoredAt time.Time
+	// Expires is when the entry stops being fresh, and StaleUntil is when it
+	// can no longer be served while it is revalidated.
+	Expires    time.Time
+	StaleUntil time.Time
+}
+
+// CacheStore stores cached responses. Implementations must be safe for
+// concurrent use.
+type CacheStore interface {
+	Get(ctx context.Context, key string) (*CacheEntry, bool, error)
+	Set(ctx context.Context, key string, entry *CacheEntry) error
+	Delete(ctx context.Context, keys ...string) error
+	// InvalidateTags deletes the entries tagged with any of tags.
+	InvalidateTags(ctx context.Context, tags ...string) error
+}
+
+// CacheConfig configures the response cache of a router group.
+type CacheConfig struct {
+	// Store defaults to an in-memory LRU store of 1024 entries.
+	Store CacheStore
+	// TTL is how long responses stay fresh.
+	TTL time.Duration
+	// StaleWhileRevalidate is how long expired responses are still served
+	// while a fresh one is computed in the background.
+	StaleWhileRevalidate time.Duration
+	// Query lists the query parameters that are part of the cache key. All
+	// of them are when it is nil.
+	Query []string
+	// VaryByAccount caches the responses of authenticated requests per
+	// account and credentials, and marks them private. Without it
+	// authenticated requests bypass the cache.
+	VaryByAccount bool
+	// MaxEntrySize is the largest body in bytes that is cached, 1 MiB by
+	// default. Larger and flushed responses are served uncached.
+	MaxEntrySize int
+	// SessionCookies lists the cookies that authenticate a request, along
+	// with the Authorization header. Any cookie does when it is empty.
+	SessionCookies []string
+}
+
+// cacheRevalidation marks the background requests refreshing stale entries.
+type cacheRevalidation struct{}
+
+type responseCache struct {
+	cfg          CacheConfig
+	engine       *echo.Echo
+	controller   gateway.Controller
+	revalidating sync.Map
+}
+
+func newResponseCache(cfg CacheConfig, engine *echo.Echo, controller gateway.Controller) (*responseCache, error) {
+	if cfg.TTL <= 0 {
+		return nil, fmt.Errorf("cache: ttl must be positive")
+	}
+	if cfg.StaleWhileRevalidate < 0 {
+		return nil, fmt.Errorf("cache: stale while revalidate must not be negative")
+	}
+	if cfg.MaxEntrySize < 0 {
+		return nil, fmt.Errorf("cache: max entry size must not be negative")
+	}
+	if cfg.MaxEntrySize == 0 {
+		cfg.MaxEntrySize = 1 << 20
+	}
+	if cfg.Store == nil {
+		cfg.Store = NewMemoryCacheStore(1024)
+	}
+	return &responseCache{cfg: cfg, engine: engine, controller: controller}, nil
+}
+
+func (rc *responseCache) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		c.Set(cacheStoreKey, rc.cfg.Store)
+		r := c.Request()
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			return next(c)
+		}
+
+		authenticated := rc.authenticated(r)
+		if authenticated && !rc.cfg.VaryByAccount {
+			c.Response().Header().Set("X-Cache", "BYPASS")
+			return next(c)
+		}
+
+		key := rc.key(c, authenticated)
+		revalidation := r.Context().Value(cacheRevalidation{}) != nil
+		if !revalidation && !strings.Contains(r.Header.Get(echo.HeaderCacheControl), "no-cache") {
+			entry, ok, err := rc.cfg.Store.Get(r.Context(), key)
+			if err != nil {
+				c.Logger().Errorf("cache: get %s: %v", key, err)
+			}
+			if err == nil && ok {
+				now := time.Now()
+				switch {
+				case now.Before(entry.Expires):
+					return rc.serve(c, entry, "HIT")
+				case now.Before(entry.StaleUntil):
+					rc.revalidate(r, key)
+					return rc.serve(c, entry, "STALE")
+				}
+			}
+		}
+
+		res := c.Response()
+		rec := &cacheRecorder{
+			ResponseWriter: res.Writer,
+			cacheControl:   rc.cacheControl(authenticated),
+			maxSize:        rc.cfg.MaxEntrySize,
+		}
+		res.Writer = rec
+		res.Header().Set("X-Cache", "MISS")
+		err := next(c)
+		res.Writer = rec.ResponseWriter
+		if err == nil && !rec.skipped && rec.status == http.StatusOK && cacheable(rec.header) {
+			rc.store(c, key, rec.header, rec.body.Bytes())
+		}
+		return err
+	}
+}
+
+// authenticated reports whether r carries credentials, so its response must
+// not be shared with other clients.
+func (rc *responseCache) authenticated(r *http.Request) bool {
+	if r.Header.Get(echo.HeaderAuthorization) != "" {
+		return true
+	}
+	if len(rc.cfg.SessionCookies) == 0 {
+		return len(r.Cookies()) > 0
+	}
+	for _, name := range rc.cfg.SessionCookies {
+		if _, err := r.Cookie(name); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (rc *responseCache) key(c echo.Context, authenticated bool) string {
+	r := c.Request()
+	query := r.URL.Query()
+	names := rc.cfg.Query
+	if names == nil {
+		for name := range query {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n", r.Method, r.URL.Path, r.Host)
+	for _, name := range names {
+		for _, v := range query[name] {
+			fmt.Fprintf(h, "%s=%s\n", name, v)
+		}
+	}
+	fmt.Fprintf(h, "%s\n%s\n", r.Header.Get(echo.HeaderAccept), r.Header.Get("Accept-Language"))
+	if authenticated {
+		// The account may only be resolved by the handlers of the route, so
+		// the credentials are part of the key as well.
+		req := getOrCreateRequest(c, rc.controller)
+		fmt.Fprintf(h, "%d\n%s\n", req.GetCurrentAccountId(), r.Header.Get(echo.HeaderAuthorization))
+		for _, cookie := range r.Cookies() {
+			if len(rc.cfg.SessionCookies) == 0 || slices.Contains(rc.cfg.SessionCookies, cookie.Name) {
+				fmt.Fprintf(h, "%s=%s\n", cookie.Name, cookie.Value)
+			}
+		}
+	}
+	return "echoserver:" + hex.EncodeToString(h.Sum(nil))
+}
+
+func (rc *responseCache) cacheControl(authenticated bool) string {
+	visibility := "public"
+	if authenticated {
+		visibility = "private"
+	}
+	cc := fmt.Sprintf("%s, max-age=%d", visibility, int(rc.cfg.TTL.Seconds()))
+	if rc.cfg.StaleWhileRevalidate > 0 {
+		cc += fmt.Sprintf(", stale-while-revalidate=%d", int(rc.cfg.StaleWhileRevalidate.Seconds()))
+	}
+	return cc
+}
+
+// serve replays entry. It keeps the X-Request-Uuid of the request that
+// computed the entry, as envelopes embed that uuid in the body.
+func (rc *responseCache) serve(c echo.Context, entry *CacheEntry, status string) error {
+	header := c.Response().Header()
+	for k, v := range entry.Header {
+		header[k] = append([]string(nil), v...)
+	}
+	header.Set("X-Cache", status)
+	header.Set("Age", strconv.Itoa(int(time.Since(entry.StoredAt).Seconds())))
+	if ifNoneMatch := c.Request().Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if etag := entry.Header.Get("ETag"); etag != "" && etagMatches(ifNoneMatch, etag, true) {
+			return c.NoContent(http.StatusNotModified)
+		}
+	}
+	c.Response().WriteHeader(entry.Status)
+	_, err := c.Response().Write(entry.Body)
+	return err
+}
+
+func (rc *responseCache) store(c echo.Context, key string, header http.Header, body []byte) {
+	stored := make(http.Header, len(header))
+	for k, v := range header {
+		switch k {
+		case "X-Cache", "Age", "Date":
+			continue
+		}
+		stored[k] = append([]string(nil), v...)
+	}
+	now := time.Now()
+	entry := &CacheEntry{
+		Status:     http.StatusOK,
+		Header:     stored,
+		Body:       append([]byte(nil), body...),
+		StoredAt:   now,
+		Expires:    now.Add(rc.cfg.TTL),
+		StaleUntil: now.Add(rc.cfg.TTL + rc.cfg.StaleWhileRevalidate),
+	}
+	if tags, ok := c.Get(cacheTagsKey).([]string); ok {
+		entry.Tags = tags
+	}
+	if err := rc.cfg.Store.Set(c.Request().Context(), key, entry); err != nil {
+		c.Logger().Errorf("cache: set %s: %v", key, err)
+	}
+}
+
+// revalidate replays the request in the background to refresh a stale
+// entry, once at a time per key.
+func (rc *responseCache) revalidate(r *http.Request, key string) {
+	if _, running := rc.revalidating.LoadOrStore(key, struct{}{}); running {
+		return
+	}
+	ctx := context.WithValue(context.Background(), cacheRevalidation{}, true)
+	clone := r.Clone(ctx)
+	clone.Header.Del("If-None-Match")
+	clone.Header.Del("If-Modified-Since")
+	go func() {
+		defer rc.revalidating.Delete(key)
+		rc.engine.ServeHTTP(&discardWriter{header: make(http.Header)}, clone)
+	}()
+}
+
+// cacheable reports whether a response may be shared according to the
+// headers set by its handler.
+func cacheable(header http.Header) bool {
+	if header.Get("Set-Cookie") != "" {
+		return false
+	}
+	cc := header.Get(echo.HeaderCacheControl)
+	return !strings.Contains(cc, "no-store") && !strings.Contains(cc, "no-cache")
+}
+
+// CacheTags tags the cached response of req, so it can be invalidated with
+// InvalidateCacheTags.
+func CacheTags(req gateway.HttpRequester, tags ...string) {
+	ctx := req.GetHttpContext().(echo.Context)
+	existing, _ := ctx.Get(cacheTagsKey).([]string)
+	ctx.Set(cacheTagsKey, append(existing, tags...))
+}
+
+// InvalidateCacheTags deletes the responses tagged with any of tags from the
+// cache store of the router group of req.
+func InvalidateCacheTags(req gateway.HttpRequester, tags ...string) error {
+	ctx := req.GetHttpContext().(echo.Context)
+	store, ok := ctx.Get(cacheStoreKey).(CacheStore)
+	if !ok {
+		return fmt.Errorf("cache: the route has no cache")
+	}
+	return store.InvalidateTags(ctx.Request().Context(), tags...)
+}
+
+// cacheRecorder copies the body written to a response, and sets the
+// Cache-Control header of successful responses that have none. header is
+// the header as the handler wrote it, before writers further out, such as
+// the compression middleware, change it for the coding they apply. Bodies
+// larger than maxSize and flushed responses, such as streams, are skipped
+// and no longer recorded.
+type cacheRecorder struct {
+	http.ResponseWriter
+	cacheControl string
+	maxSize      int
+	status       int
+	header       http.Header
+	body         bytes.Buffer
+	skipped      bool
+}
+
+func (w *cacheRecorder) skip() {
+	w.skipped = true
+	w.body = bytes.Buffer{}
+}
+
+func (w *cacheRecorder) WriteHeader(code int) {
+	w.status = code
+	header := w.Header()
+	if code == http.StatusOK && header.Get(echo.HeaderCacheControl) == "" {
+		header.Set(echo.HeaderCacheControl, w.cacheControl)
+	}
+	w.header = header.Clone()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cacheRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.skipped {
+		if w.body.Len()+len(b) > w.maxSize {
+			w.skip()
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *cacheRecorder) Flush() {
+	w.skip()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardWriter) WriteHeader(int)             {}
+
+type memoryCacheItem struct {
+	key   string
+	entry *CacheEntry
+}
+
+// memoryCacheStore is an in-memory CacheStore evicting the least recently
+// used entries.
+type memoryCacheStore struct {
+	mtx      sync.Mutex
+	capacity int
+	items    map[string]*list.Element
+	order    *list.List
+	tags     map[string]map[string]struct{}
+}
+
+func NewMemoryCacheStore(capacity int) CacheStore {
+	if capacity <= 0 {
+		capacity = 1024
+	}
+	return &memoryCacheStore{
+		capacity: capacity,
+		items:    make(map[string]*list.Element),
+		order:    list.New(),
+		tags:     make(map[string]map[string]struct{}),
+	}
+}
+
+func (s *memoryCacheStore) Get(_ context.Context, key string) (*CacheEntry, bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	el, ok := s.items[key]
+	if !ok {
+		return nil, false, nil
+	}
+	item := el.Value.(*memoryCacheItem)
+	if time.Now().After(item.entry.StaleUntil) {
+		s.remove(el)
+		return nil, false, nil
+	}
+	s.order.MoveToFront(el)
+	return item.entry, true, nil
+}
+
+func (s *memoryCacheStore) Set(_ context.Context, key string, entry *CacheEntry) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if el, ok := s.items[key]; ok {
+		s.remove(el)
+	}
+	s.items[key] = s.order.PushFront(&memoryCacheItem{key: key, entry: entry})
+	for _, tag := range entry.Tags {
+		if s.tags[tag] == nil {
+			s.tags[tag] = make(map[string]struct{})
+		}
+		s.tags[tag][key] = struct{}{}
+	}
+	for s.order.Len() > s.capacity {
+		s.remove(s.order.Back())
+	}
+	return nil
+}
+
+func (s *memoryCacheStore) Delete(_ context.Context, keys ...string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, key := range keys {
+		if el, ok := s.items[key]; ok {
+			s.remove(el)
+		}
+	}
+	return nil
+}
+
+func (s *memoryCacheStore) InvalidateTags(_ context.Context, tags ...string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, tag := range tags {
+		for key := range s.tags[tag] {
+			if el, ok := s.items[key]; ok {
+				s.remove(el)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *memoryCacheStore) remove(el *list.Element) {
+	item := el.Value.(*memoryCacheItem)
+	s.order.Remove(el)
+	delete(s.items, item.key)
+	for _, tag := range item.entry.Tags {
+		delete(s.tags[tag], item.key)
+		if len(s.tags[tag]) == 0 {
+			delete(s.tags, tag)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package echoserver
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// cborEncMode encodes maps with sorted keys and numbers in their shortest
+// form, as RFC 8949 core deterministic encoding requires.
+var cborEncMode, _ = cbor.CoreDetEncOptions().EncMode()
+
+// cborDecMode bounds nesting and the number of array elements and map pairs.
+// Documents are checked to be well formed before anything is allocated for
+// them, so declared lengths are bounded by the data.
+var cborDecMode, _ = cbor.DecOptions{
+	MaxNestedLevels: maxDecodeDepth,
+	DefaultMapType:  reflect.TypeOf(map[string]any(nil)),
+}.DecMode()
+
+// encodeCBOR writes the CBOR (RFC 8949) representation of the json encoding
+// of v.
+func encodeCBOR(w io.Writer, v any) error {
+	g, err := toGeneric(v)
+	if err != nil {
+		return err
+	}
+	return cborEncMode.NewEncoder(w).Encode(fromJSONNumbers(g))
+}
+
+// decodeCBOR decodes a CBOR document into v through its json representation,
+// so json tags apply.
+func decodeCBOR(r io.Reader, v any) error {
+	var g any
+	if err := cborDecMode.NewDecoder(r).Decode(&g); err != nil {
+		return fmt.Errorf("cbor: %w", err)
+	}
+	return fromGeneric(g, v)
+}
@@ -0,0 +1,361 @@
+package echoserver
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aliworkshop/errors"
+	"github.com/aliworkshop/gateway/v2"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/labstack/echo/v4"
+)
+
+const noCompressionKey = "_echoserver.no_compression"
+
+type CompressionConfig struct {
+	Enabled bool
+	// MinSize is the body size in bytes below which responses are sent
+	// uncompressed.
+	MinSize int
+	// Level ranges from 1, the fastest, to 9, the best compression. Each
+	// compressor maps it onto the levels of its coding. Zero is the default
+	// level of the coding.
+	Level int
+	// ExcludedContentTypes are media types, or type/* ranges, never
+	// compressed. Already compressed media are excluded by default.
+	ExcludedContentTypes []string
+	// Encodings lists the content codings in order of preference. Codings
+	// without a registered compressor are skipped.
+	Encodings []string
+}
+
+func (c *CompressionConfig) initialize() {
+	if c.MinSize == 0 {
+		c.MinSize = 1024
+	}
+	if c.ExcludedContentTypes == nil {
+		c.ExcludedContentTypes = []string{
+			"image/*", "video/*", "audio/*", "font/woff", "font/woff2",
+			"application/zip", "application/gzip", "application/x-gzip",
+			"application/zstd", "application/x-7z-compressed", "application/pdf",
+			"text/event-stream",
+		}
+	}
+	if c.Encodings == nil {
+		c.Encodings = []string{"zstd", "br", "gzip", "deflate"}
+	}
+}
+
+// CompressorFactory creates a writer compressing into w at level, from 1 to 9
+// as CompressionConfig.Level, zero being the default level of the coding.
+type CompressorFactory func(w io.Writer, level int) (io.WriteCloser, error)
+
+var (
+	compressors = map[string]CompressorFactory{
+		"gzip":    newGzipWriter,
+		"deflate": newFlateWriter,
+		"br":      newBrotliWriter,
+		"zstd":    newZstdWriter,
+	}
+	compressorsMtx sync.RWMutex
+)
+
+// RegisterCompressor makes a content coding available to the compression
+// middleware. Registering an existing coding replaces its
+// factory.
+func RegisterCompressor(encoding string, factory CompressorFactory) {
+	compressorsMtx.Lock()
+	defer compressorsMtx.Unlock()
+	compressors[strings.ToLower(encoding)] = factory
+}
+
+func getCompressor(encoding string) (CompressorFactory, bool) {
+	compressorsMtx.RLock()
+	defer compressorsMtx.RUnlock()
+	f, ok := compressors[encoding]
+	return f, ok
+}
+
+func newGzipWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	return gzip.NewWriterLevel(w, level)
+}
+
+func newFlateWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	return flate.NewWriter(w, level)
+}
+
+// newBrotliWriter spreads levels 1 to 9 over the brotli levels 1 to 11.
+func newBrotliWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	if level == 0 {
+		return brotli.NewWriterLevel(w, brotli.DefaultCompression), nil
+	}
+	return brotli.NewWriterLevel(w, 1+(level-1)*10/8), nil
+}
+
+// newZstdWriter maps levels 1 to 9 onto the four zstd encoder levels.
+func newZstdWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	options := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+	switch {
+	case level == 0:
+	case level <= 2:
+		options = append(options, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	case level <= 5:
+		options = append(options, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	case level <= 8:
+		options = append(options, zstd.WithEncoderLevel(zstd.SpeedBetterCompression))
+	default:
+		options = append(options, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	}
+	return zstd.NewWriter(w, options...)
+}
+
+// NoCompression is a handler opting the routes it guards out of response
+// compression.
+var NoCompression gateway.Handler = noCompressionHandler{}
+
+type noCompressionHandler struct{}
+
+func (noCompressionHandler) Handle(req gateway.HttpRequester) (any, errors.ErrorModel) {
+	req.GetHttpContext().(echo.Context).Set(noCompressionKey, true)
+	return nil, nil
+}
+
+// negotiateEncoding picks the most preferred of encodings acceptable
+// according to an Accept-Encoding header.
+func negotiateEncoding(header string, encodings []string) string {
+	if header == "" {
+		return ""
+	}
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(coding))] = q
+	}
+	var best string
+	var bestQ float64
+	for _, encoding := range encodings {
+		if _, ok := getCompressor(encoding); !ok {
+			continue
+		}
+		q, ok := accepted[encoding]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// compressionMiddleware compresses responses with the coding negotiated
+// from Accept-Encoding. Bodies are streamed through the compressor once
+// MinSize bytes are written or the handler flushes, so streams and files are
+// never buffered whole. WebSocket upgrades are left alone.
+func compressionMiddleware(live *liveConfig) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			cfg := live.Load().Compression
+			r := c.Request()
+			if !cfg.Enabled || r.Method == http.MethodHead || isUpgrade(r) {
+				return next(c)
+			}
+			res := c.Response()
+			res.Header().Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+			encoding := negotiateEncoding(r.Header.Get(echo.HeaderAcceptEncoding), cfg.Encodings)
+			if encoding == "" {
+				return next(c)
+			}
+			cw := &compressWriter{
+				ResponseWriter: res.Writer,
+				ctx:            c,
+				cfg:            cfg,
+				encoding:       encoding,
+			}
+			res.Writer = cw
+			defer func() {
+				cw.Close()
+				res.Writer = cw.ResponseWriter
+			}()
+			return next(c)
+		}
+	}
+}
+
+func isUpgrade(r *http.Request) bool {
+	return strings.Contains(strings.ToLower(r.Header.Get(echo.HeaderConnection)), "upgrade") ||
+		r.Header.Get(echo.HeaderUpgrade) != ""
+}
+
+// compressWriter holds back the status and the first MinSize bytes of a
+// response until it can decide whether to compress it.
+type compressWriter struct {
+	http.ResponseWriter
+	ctx      echo.Context
+	cfg      CompressionConfig
+	encoding string
+
+	status     int
+	buf        bytes.Buffer
+	decided    bool
+	compressor io.WriteCloser
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.decided {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.status = code
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.decided {
+		w.buf.Write(b)
+		if w.buf.Len() < w.cfg.MinSize {
+			return len(b), nil
+		}
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if w.compressor != nil {
+		return w.compressor.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// decide sends the headers and the held back bytes, compressed when large
+// is set and the response qualifies.
+func (w *compressWriter) decide(large bool) error {
+	w.decided = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if large && w.shouldCompress() {
+		compressor, err := w.newCompressor()
+		if err == nil {
+			header := w.Header()
+			header.Set(echo.HeaderContentEncoding, w.encoding)
+			header.Del(echo.HeaderContentLength)
+			if etag := header.Get("ETag"); etag != "" {
+				header.Set("ETag", codingETag(etag, w.encoding))
+			}
+			w.compressor = compressor
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	var err error
+	if w.compressor != nil {
+		_, err = w.compressor.Write(w.buf.Bytes())
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf.Bytes())
+	}
+	w.buf.Reset()
+	return err
+}
+
+func (w *compressWriter) newCompressor() (io.WriteCloser, error) {
+	factory, ok := getCompressor(w.encoding)
+	if !ok {
+		return nil, fmt.Errorf("compression: unknown encoding %s", w.encoding)
+	}
+	return factory(w.ResponseWriter, w.cfg.Level)
+}
+
+func (w *compressWriter) shouldCompress() bool {
+	if optOut, _ := w.ctx.Get(noCompressionKey).(bool); optOut {
+		return false
+	}
+	switch {
+	case w.status < http.StatusOK,
+		w.status == http.StatusNoContent,
+		w.status == http.StatusNotModified,
+		w.status == http.StatusPartialContent:
+		return false
+	}
+	header := w.Header()
+	if header.Get(echo.HeaderContentEncoding) != "" || header.Get("Content-Range") != "" {
+		return false
+	}
+	contentType := header.Get(echo.HeaderContentType)
+	if contentType == "" {
+		contentType = http.DetectContentType(w.buf.Bytes())
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return true
+	}
+	for _, excluded := range w.cfg.ExcludedContentTypes {
+		if excluded == mediaType || strings.HasSuffix(excluded, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(excluded, "*")) {
+			return false
+		}
+	}
+	return true
+}
+
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		w.decide(true)
+	}
+	if f, ok := w.compressor.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, fmt.Errorf("compression: the response writer does not support hijacking")
+}
+
+// Close sends what is held back and terminates the compressed stream.
+func (w *compressWriter) Close() error {
+	if !w.decided {
+		if w.status == 0 && w.buf.Len() == 0 {
+			return nil
+		}
+		if err := w.decide(false); err != nil {
+			return err
+		}
+	}
+	if w.compressor != nil {
+		return w.compressor.Close()
+	}
+	return nil
+}
@@ -1,21 +1,35 @@
 package echoserver
 
 import (
-	"github.com/labstack/echo/v4"
+	"fmt"
 	"net/http"
+	"strings"
 	"time"
+
+	"github.com/labstack/echo/v4"
 )
 
 type CSRFConfig struct {
-	CookieKey string
-	HeaderKey string
+	CookieKey      string
+	HeaderKey      string
+	CookiePath     string
+	CookieDomain   string
+	CookieMaxAge   time.Duration
+	CookieSecure   bool
+	CookieSameSite string
+}
+
+type middlewareEntry struct {
+	Type   string
+	Config interface{}
+	// Global attaches the middleware to every route of the server.
+	Global bool
+	// Groups lists the router group paths the middleware is attached to.
+	Groups []string
 }
 
 type middlewareConfig struct {
-	Middlewares map[string]struct {
-		Type   string
-		Config interface{}
-	}
+	Middlewares map[string]middlewareEntry
 }
 
 type Http struct {
@@ -24,8 +38,41 @@ type Http struct {
 		SkipPaths []string
 	}
 	ConnectionTimeout time.Duration
-	ServiceName       string `mapstructure:"servicename"`
-	CSRF              struct {
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	// MaxBodyBytes bounds the request bodies read by BindRequest and
+	// BindPatch, 4 MiB by default. Larger bodies are answered with 413.
+	MaxBodyBytes      int64
+	DisableKeepAlives bool
+	TLS               TLSConfig
+	// ReloadInterval enables reloading the hot reloadable sections of the
+	// config from the registry periodically. Registries reporting changes, see
+	// ConfigWatcher, are reloaded on every change regardless.
+	ReloadInterval time.Duration
+	Shutdown       struct {
+		// DrainDelay is how long the server keeps serving after readiness
+		// flips, so load balancers stop routing to it.
+		DrainDelay  time.Duration
+		HookTimeout time.Duration
+	}
+	Metrics    MetricsConfig
+	Admin      AdminConfig
+	Pagination PaginationConfig
+	// Compression configures the negotiated compression of responses.
+	Compression CompressionConfig
+	// Envelope is the name of the envelope wrapping results: bare, items
+	// (the default), jsonapi, hal or one added with RegisterEnvelope.
+	Envelope string
+	Health   struct {
+		Path string
+		// Timeout is the default timeout of a single health check.
+		Timeout time.Duration
+	}
+	ServiceName string `mapstructure:"servicename"`
+	CSRF        struct {
 		SessionTypes map[string]*CSRFConfig
 	}
 	Cors struct {
@@ -44,6 +91,29 @@ func (c *config) Initialize() {
 	if c.ConnectionTimeout == 0 {
 		c.ConnectionTimeout = time.Second * 30
 	}
+	if c.ReadHeaderTimeout == 0 {
+		c.ReadHeaderTimeout = c.ConnectionTimeout
+	}
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = c.ConnectionTimeout
+	}
+	if c.MaxBodyBytes == 0 {
+		c.MaxBodyBytes = defaultMaxBodyBytes
+	}
+	if c.Shutdown.HookTimeout == 0 {
+		c.Shutdown.HookTimeout = time.Second * 10
+	}
+	if c.Health.Path == "" {
+		c.Health.Path = "/monitoring/health"
+	}
+	if c.Health.Timeout == 0 {
+		c.Health.Timeout = time.Second * 5
+	}
+	c.Metrics.initialize()
+	c.Compression.initialize()
+	if c.Pagination.PageSize.Max == 0 {
+		c.Pagination.PageSize.Max = 100
+	}
 	if c.CSRF.SessionTypes == nil {
 		c.CSRF.SessionTypes = map[string]*CSRFConfig{
 			"DEFAULT": {
@@ -74,3 +144,54 @@ func (c *config) Initialize() {
 		}
 	}
 }
+
+func (c *config) validate() error {
+	for _, origin := range c.Cors.AllowOrigins {
+		if origin != "*" && !strings.Contains(origin, "://") {
+			return fmt.Errorf("cors: invalid origin %q", origin)
+		}
+	}
+	timeouts := map[string]time.Duration{
+		"ConnectionTimeout": c.ConnectionTimeout,
+		"ReadTimeout":       c.ReadTimeout,
+		"ReadHeaderTimeout": c.ReadHeaderTimeout,
+		"WriteTimeout":      c.WriteTimeout,
+		"IdleTimeout":       c.IdleTimeout,
+		"ReloadInterval":    c.ReloadInterval,
+		"DrainDelay":        c.Shutdown.DrainDelay,
+		"HookTimeout":       c.Shutdown.HookTimeout,
+		"Health.Timeout":    c.Health.Timeout,
+	}
+	for name, t := range timeouts {
+		if t < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+	if c.MaxHeaderBytes < 0 {
+		return fmt.Errorf("MaxHeaderBytes must not be negative")
+	}
+	if c.MaxBodyBytes < 0 {
+		return fmt.Errorf("MaxBodyBytes must not be negative")
+	}
+	if _, ok := getEnvelope(c.Envelope); c.Envelope != "" && !ok {
+		return fmt.Errorf("envelope %s is not registered", c.Envelope)
+	}
+	if ps := c.Pagination.PageSize; ps.Default < 0 || ps.Max > 0 && ps.Default > ps.Max {
+		return fmt.Errorf("pagination: default page size %d is out of range", ps.Default)
+	}
+	if s := c.Pagination.CursorSecret; s != "" && len(s) < minCursorSecretLen {
+		return fmt.Errorf("pagination: CursorSecret must be at least %d bytes", minCursorSecretLen)
+	}
+	if c.Compression.MinSize < 0 {
+		return fmt.Errorf("compression: MinSize must not be negative")
+	}
+	if c.Compression.Level < 0 || c.Compression.Level > 9 {
+		return fmt.Errorf("compression: Level %d is out of range 0-9", c.Compression.Level)
+	}
+	for name, st := range c.CSRF.SessionTypes {
+		if st == nil || st.CookieKey == "" || st.HeaderKey == "" {
+			return fmt.Errorf("csrf: session type %s needs a cookie and a header key", name)
+		}
+	}
+	return nil
+}
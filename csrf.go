@@ -0,0 +1,106 @@
+package echoserver
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aliworkshop/errors"
+	"github.com/aliworkshop/gateway/v2"
+)
+
+const csrfTokenKey = "_echoserver.csrf_token"
+
+// csrfHandler implements the double-submit-cookie pattern: a random token is
+// issued in a cookie readable by the client, which must echo it back in a
+// header on every unsafe request.
+type csrfHandler struct {
+	live        *liveConfig
+	sessionType string
+	// fallback keeps the session type enforced if a reload removes it.
+	fallback *CSRFConfig
+}
+
+func newCSRFHandler(live *liveConfig, sessionType string) (*csrfHandler, error) {
+	sessionType = strings.ToUpper(sessionType)
+	cfg, ok := live.Load().CSRF.SessionTypes[sessionType]
+	if !ok || cfg == nil {
+		return nil, fmt.Errorf("csrf session type %s is not configured", sessionType)
+	}
+	return &csrfHandler{live: live, sessionType: sessionType, fallback: cfg}, nil
+}
+
+func (h *csrfHandler) current() *CSRFConfig {
+	if cfg := h.live.Load().CSRF.SessionTypes[h.sessionType]; cfg != nil {
+		return cfg
+	}
+	return h.fallback
+}
+
+func (h *csrfHandler) Handle(req gateway.HttpRequester) (any, errors.ErrorModel) {
+	cfg := h.current()
+	token, _ := req.Cookie(cfg.CookieKey)
+	if token == "" {
+		token = newCSRFToken()
+		req.SetCookie(csrfCookie(cfg, token))
+	}
+	req.SetKey(csrfTokenKey, token)
+
+	switch req.GetMethod() {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return nil, nil
+	}
+	header := req.GetHeader(cfg.HeaderKey)
+	if header == "" || subtle.ConstantTimeCompare([]byte(header), []byte(token)) != 1 {
+		return nil, errors.Forbidden().WithMessage("invalid csrf token")
+	}
+	return nil, nil
+}
+
+func csrfCookie(cfg *CSRFConfig, token string) *http.Cookie {
+	path := cfg.CookiePath
+	if path == "" {
+		path = "/"
+	}
+	return &http.Cookie{
+		Name:     cfg.CookieKey,
+		Value:    token,
+		Path:     path,
+		Domain:   cfg.CookieDomain,
+		MaxAge:   int(cfg.CookieMaxAge.Seconds()),
+		Secure:   cfg.CookieSecure,
+		SameSite: parseSameSite(cfg.CookieSameSite),
+	}
+}
+
+func parseSameSite(s string) http.SameSite {
+	switch strings.ToLower(s) {
+	case "lax":
+		return http.SameSiteLaxMode
+	case "none":
+		return http.SameSiteNoneMode
+	case "default":
+		return http.SameSiteDefaultMode
+	}
+	return http.SameSiteStrictMode
+}
+
+func newCSRFToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// CSRFToken returns the csrf token issued for the request, so it can be
+// embedded in rendered pages.
+func CSRFToken(req gateway.HttpRequester) string {
+	if v, ok := req.GetKey(csrfTokenKey); ok {
+		return v.(string)
+	}
+	return ""
+}
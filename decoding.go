@@ -0,0 +1,202 @@
+package echoserver
+
+import (
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/aliworkshop/errors"
+	"github.com/labstack/echo/v4"
+	"go.yaml.in/yaml/v3"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	MIMEApplicationNDJSON = "application/x-ndjson"
+	MIMEApplicationYAML   = "application/yaml"
+)
+
+// maxDecodeDepth bounds the nesting of MessagePack and CBOR request bodies.
+const maxDecodeDepth = 64
+
+const (
+	bodyLimitKey        = "_echoserver.body_limit"
+	defaultMaxBodyBytes = 4 << 20
+)
+
+func injectBodyLimit(live *liveConfig) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set(bodyLimitKey, live.Load().MaxBodyBytes)
+			return next(c)
+		}
+	}
+}
+
+// limitBody makes reading the body of the request past Http.MaxBodyBytes
+// fail with an http.MaxBytesError.
+func limitBody(c echo.Context) {
+	limit, _ := c.Get(bodyLimitKey).(int64)
+	if limit <= 0 {
+		limit = defaultMaxBodyBytes
+	}
+	req := c.Request()
+	req.Body = http.MaxBytesReader(c.Response(), req.Body, limit)
+}
+
+// Decoder deserializes request bodies of a media type.
+type Decoder interface {
+	Decode(r io.Reader, v any) error
+}
+
+// DecoderFunc adapts a function to a Decoder.
+type DecoderFunc func(r io.Reader, v any) error
+
+func (f DecoderFunc) Decode(r io.Reader, v any) error {
+	return f(r, v)
+}
+
+var (
+	decoders = map[string]Decoder{
+		MIMEApplicationMsgpack:       DecoderFunc(decodeMsgpack),
+		"application/x-msgpack":      DecoderFunc(decodeMsgpack),
+		"application/vnd.msgpack":    DecoderFunc(decodeMsgpack),
+		MIMEApplicationCBOR:          DecoderFunc(decodeCBOR),
+		MIMEApplicationProtobuf:      DecoderFunc(decodeProtobuf),
+		echo.MIMEApplicationProtobuf: DecoderFunc(decodeProtobuf),
+		MIMEApplicationNDJSON:        DecoderFunc(decodeNDJSON),
+		"application/jsonl":          DecoderFunc(decodeNDJSON),
+		MIMEApplicationYAML:          DecoderFunc(decodeYAML),
+		"application/x-yaml":         DecoderFunc(decodeYAML),
+		"text/yaml":                  DecoderFunc(decodeYAML),
+		"text/x-yaml":                DecoderFunc(decodeYAML),
+	}
+	decodersMtx sync.RWMutex
+)
+
+// RegisterDecoder makes a Content-Type available to BindRequest. Json, xml and
+// form bodies are always bound by echo and cannot be overridden.
+func RegisterDecoder(mediaType string, decoder Decoder) {
+	decodersMtx.Lock()
+	defer decodersMtx.Unlock()
+	decoders[strings.ToLower(mediaType)] = decoder
+}
+
+func getDecoder(mediaType string) (Decoder, bool) {
+	decodersMtx.RLock()
+	defer decodersMtx.RUnlock()
+	d, ok := decoders[mediaType]
+	return d, ok
+}
+
+// bind binds path params, query params for GET, DELETE and HEAD, and the
+// body like echo's default binder, using the registered decoders for the
+// Content-Types echo does not understand.
+func bind(c echo.Context, i any) error {
+	limitBody(c)
+	req := c.Request()
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get(echo.HeaderContentType))
+	switch {
+	case req.ContentLength == 0, mediaType == "",
+		strings.HasPrefix(mediaType, echo.MIMEApplicationJSON),
+		strings.HasPrefix(mediaType, echo.MIMEApplicationXML),
+		strings.HasPrefix(mediaType, echo.MIMETextXML),
+		strings.HasPrefix(mediaType, echo.MIMEApplicationForm),
+		strings.HasPrefix(mediaType, echo.MIMEMultipartForm):
+		return c.Bind(i)
+	}
+	decoder, ok := getDecoder(mediaType)
+	if !ok {
+		return echo.ErrUnsupportedMediaType
+	}
+
+	b := &echo.DefaultBinder{}
+	if err := b.BindPathParams(c, i); err != nil {
+		return err
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodDelete, http.MethodHead:
+		if err := b.BindQueryParams(c, i); err != nil {
+			return err
+		}
+	}
+	if err := decoder.Decode(req.Body, i); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error()).SetInternal(err)
+	}
+	return nil
+}
+
+// bindError converts a binding error to the error model, keeping the status
+// of unsupported media types and too large bodies.
+func bindError(err error) errors.ErrorModel {
+	var tooLarge *http.MaxBytesError
+	if stderrors.As(err, &tooLarge) {
+		err = fmt.Errorf("request body exceeds %d bytes", tooLarge.Limit)
+		return NewTypedError(TypeRequestTooLarge, "request_too_large", err).WithProperty("error", err.Error())
+	}
+	if he, ok := err.(*echo.HTTPError); ok && he.Code == http.StatusUnsupportedMediaType {
+		return NewTypedError(TypeUnsupportedMediaType, "unsupported_media_type", err).WithProperty("error", err.Error())
+	}
+	return errors.Validation(err).WithProperty("error", err.Error())
+}
+
+// fromGeneric stores a decoded document in v through its json encoding.
+func fromGeneric(g any, v any) error {
+	b, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func decodeProtobuf(r io.Reader, v any) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("protobuf: %T is not a proto message", v)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(b, m)
+}
+
+// decodeYAML decodes a YAML document into v through its json representation,
+// so json tags apply.
+func decodeYAML(r io.Reader, v any) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var g any
+	if err := yaml.Unmarshal(b, &g); err != nil {
+		return fmt.Errorf("yaml: %w", err)
+	}
+	return fromGeneric(g, v)
+}
+
+// decodeNDJSON appends every line of a newline delimited json body to the
+// slice v points to.
+func decodeNDJSON(r io.Reader, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("ndjson: %T is not a pointer to a slice", v)
+	}
+	slice := rv.Elem()
+	d := json.NewDecoder(r)
+	for {
+		item := reflect.New(slice.Type().Elem())
+		if err := d.Decode(item.Interface()); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("ndjson: %w", err)
+		}
+		slice.Set(reflect.Append(slice, item.Elem()))
+	}
+}
@@ -0,0 +1,414 @@
+package echoserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/aliworkshop/gateway/v2"
+	"github.com/labstack/echo/v4"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	MIMEApplicationMsgpack  = "application/msgpack"
+	MIMEApplicationCBOR     = "application/cbor"
+	MIMEApplicationProtobuf = "application/x-protobuf"
+)
+
+// Encoder serializes response bodies of a media type.
+type Encoder interface {
+	Encode(w io.Writer, v any) error
+}
+
+// EncoderFunc adapts a function to an Encoder.
+type EncoderFunc func(w io.Writer, v any) error
+
+func (f EncoderFunc) Encode(w io.Writer, v any) error {
+	return f(w, v)
+}
+
+var (
+	encoders = map[string]Encoder{
+		echo.MIMEApplicationJSON:     EncoderFunc(encodeJSON),
+		echo.MIMEApplicationXML:      EncoderFunc(encodeXML),
+		echo.MIMETextXML:             EncoderFunc(encodeXML),
+		MIMEApplicationMsgpack:       EncoderFunc(encodeMsgpack),
+		"application/x-msgpack":      EncoderFunc(encodeMsgpack),
+		"application/vnd.msgpack":    EncoderFunc(encodeMsgpack),
+		MIMEApplicationCBOR:          EncoderFunc(encodeCBOR),
+		MIMEApplicationProtobuf:      protobufEncoder{},
+		echo.MIMEApplicationProtobuf: protobufEncoder{},
+	}
+	encodersMtx sync.RWMutex
+)
+
+// RegisterEncoder makes a media type available to content negotiation.
+// Registering an existing media type replaces its encoder.
+func RegisterEncoder(mediaType string, encoder Encoder) {
+	encodersMtx.Lock()
+	defer encodersMtx.Unlock()
+	encoders[strings.ToLower(mediaType)] = encoder
+}
+
+func getEncoder(mediaType string) (Encoder, bool) {
+	encodersMtx.RLock()
+	defer encodersMtx.RUnlock()
+	e, ok := encoders[mediaType]
+	return e, ok
+}
+
+type acceptedType struct {
+	mediaType string
+	q         float64
+	order     int
+}
+
+// parseAccept returns the media ranges of an Accept header ordered by
+// preference.
+func parseAccept(header string) []acceptedType {
+	var accepted []acceptedType
+	for i, part := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		accepted = append(accepted, acceptedType{mediaType: mediaType, q: q, order: i})
+	}
+	sort.SliceStable(accepted, func(i, j int) bool {
+		if accepted[i].q != accepted[j].q {
+			return accepted[i].q > accepted[j].q
+		}
+		return specificity(accepted[i].mediaType) > specificity(accepted[j].mediaType)
+	})
+	return accepted
+}
+
+func specificity(mediaType string) int {
+	switch {
+	case mediaType == "*/*":
+		return 0
+	case strings.HasSuffix(mediaType, "/*"):
+		return 1
+	}
+	return 2
+}
+
+// negotiateEncoders lists the registered media types acceptable to an Accept
+// header, most preferred first, falling back to json when none is. Browsers
+// list xml below q=1 next to html and */*, so for their headers json ranks
+// above every type qualified below 1.
+func negotiateEncoders(accept string) []string {
+	accepted := parseAccept(accept)
+	var wildcard, html bool
+	for _, a := range accepted {
+		switch a.mediaType {
+		case "*/*":
+			wildcard = true
+		case echo.MIMETextHTML, "application/xhtml+xml":
+			html = true
+		}
+	}
+	browser := wildcard && html
+	var types []string
+	seen := make(map[string]bool)
+	add := func(mediaType string) {
+		if !seen[mediaType] {
+			seen[mediaType] = true
+			types = append(types, mediaType)
+		}
+	}
+	for _, a := range accepted {
+		if browser && a.q < 1 {
+			add(echo.MIMEApplicationJSON)
+		}
+		switch {
+		case a.mediaType == "*/*" || a.mediaType == "application/*":
+			add(echo.MIMEApplicationJSON)
+		case strings.HasSuffix(a.mediaType, "/*"):
+			for _, mediaType := range encodersWithPrefix(strings.TrimSuffix(a.mediaType, "*")) {
+				add(mediaType)
+			}
+		default:
+			if _, ok := getEncoder(a.mediaType); ok {
+				add(a.mediaType)
+			}
+		}
+	}
+	if len(types) == 0 {
+		return []string{echo.MIMEApplicationJSON}
+	}
+	return types
+}
+
+func encodersWithPrefix(prefix string) []string {
+	encodersMtx.RLock()
+	defer encodersMtx.RUnlock()
+	var types []string
+	for mediaType := range encoders {
+		if strings.HasPrefix(mediaType, prefix) {
+			types = append(types, mediaType)
+		}
+	}
+	sort.Strings(types)
+	return types
+}
+
+// HeaderEncoder is implemented by encoders of formats that cannot represent
+// the response envelopes. EncodeHeaders moves the envelope metadata of v to
+// response headers.
+type HeaderEncoder interface {
+	Encoder
+	EncodeHeaders(h http.Header, v any)
+}
+
+// errNotAcceptable is returned when no acceptable encoder can represent a
+// body.
+var errNotAcceptable = echo.NewHTTPError(http.StatusNotAcceptable)
+
+// respondNegotiated writes body with the encoder negotiated from the Accept
+// header of the request, or answers 406 Not Acceptable when no acceptable
+// format can represent it.
+func respondNegotiated(ctx echo.Context, code int, body any) error {
+	ctx.Response().Header().Add(echo.HeaderVary, echo.HeaderAccept)
+	mediaType, b, err := encodeNegotiated(ctx, body)
+	if err == errNotAcceptable {
+		return ctx.String(http.StatusNotAcceptable, http.StatusText(http.StatusNotAcceptable))
+	}
+	if err != nil {
+		return err
+	}
+	return ctx.Blob(code, mediaType, b)
+}
+
+// respondNegotiatedError writes an error body like respondNegotiated, but
+// falls back to json when no acceptable format can represent it, so the
+// status of the error is kept.
+func respondNegotiatedError(ctx echo.Context, code int, body any) error {
+	ctx.Response().Header().Add(echo.HeaderVary, echo.HeaderAccept)
+	mediaType, b, err := encodeNegotiated(ctx, body)
+	if err == errNotAcceptable {
+		return ctx.JSON(code, body)
+	}
+	if err != nil {
+		return err
+	}
+	return ctx.Blob(code, mediaType, b)
+}
+
+// encodeNegotiated encodes body with the first acceptable encoder able to
+// represent it. It returns errNotAcceptable when none is, unless json was
+// acceptable, whose error is returned instead.
+func encodeNegotiated(ctx echo.Context, body any) (string, []byte, error) {
+	var jsonErr error
+	projected, _ := ctx.Get(fieldsProjectedKey).(bool)
+	for _, mediaType := range negotiateEncoders(ctx.Request().Header.Get(echo.HeaderAccept)) {
+		encoder, ok := getEncoder(mediaType)
+		if !ok || projected && !encodesMaps(encoder) {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := encoder.Encode(&buf, body); err != nil {
+			if mediaType == echo.MIMEApplicationJSON {
+				jsonErr = err
+			}
+			continue
+		}
+		if he, ok := encoder.(HeaderEncoder); ok {
+			he.EncodeHeaders(ctx.Response().Header(), body)
+		}
+		if mediaType == echo.MIMEApplicationJSON {
+			mediaType = echo.MIMEApplicationJSONCharsetUTF8
+		}
+		return mediaType, buf.Bytes(), nil
+	}
+	if jsonErr != nil {
+		return "", nil, jsonErr
+	}
+	return "", nil, errNotAcceptable
+}
+
+func encodeJSON(w io.Writer, v any) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+// encodeXML writes the xml representation of the json encoding of v, so xml
+// bodies mirror json ones: objects become elements named after their members
+// under a response root and array items repeat an item element. Values
+// implementing xml.Marshaler are encoded as they define.
+func encodeXML(w io.Writer, v any) error {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	e := xml.NewEncoder(&buf)
+	if m, ok := v.(xml.Marshaler); ok {
+		if err := e.Encode(m); err != nil {
+			return err
+		}
+	} else {
+		g, err := toGeneric(v)
+		if err != nil {
+			return err
+		}
+		if err := writeXMLElement(e, "response", g); err != nil {
+			return err
+		}
+	}
+	if err := e.Flush(); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// writeXMLElement writes v as an element. Names that are not valid xml names
+// are written as an entry element with a key attribute.
+func writeXMLElement(e *xml.Encoder, name string, v any) error {
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	if !isXMLName(name) {
+		start = xml.StartElement{
+			Name: xml.Name{Local: "entry"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: name}},
+		}
+	}
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case nil:
+	case map[string]any:
+		keys := make([]string, 0, len(value))
+		for k := range value {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if err := writeXMLElement(e, k, value[k]); err != nil {
+				return err
+			}
+		}
+	case []any:
+		for _, item := range value {
+			if err := writeXMLElement(e, "item", item); err != nil {
+				return err
+			}
+		}
+	default:
+		if err := e.EncodeToken(xml.CharData(fmt.Sprint(value))); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+func isXMLName(name string) bool {
+	if name == "" || strings.HasPrefix(strings.ToLower(name), "xml") {
+		return false
+	}
+	for i, r := range name {
+		switch {
+		case r == '_' || unicode.IsLetter(r):
+		case i > 0 && (r == '-' || r == '.' || unicode.IsDigit(r)):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// protobufEncoder encodes proto messages. Protobuf has no representation of
+// the response envelopes, so their items are encoded and their metadata is
+// moved to headers.
+type protobufEncoder struct{}
+
+func (protobufEncoder) Encode(w io.Writer, v any) error {
+	switch r := v.(type) {
+	case gateway.Response:
+		v = r.Items
+	case CursorResponse:
+		v = r.Items
+	}
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("protobuf: %T is not a proto message", v)
+	}
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func (protobufEncoder) EncodeHeaders(h http.Header, v any) {
+	switch r := v.(type) {
+	case gateway.Response:
+		h.Set("X-Page", strconv.Itoa(r.Page))
+		h.Set("X-Page-Size", strconv.Itoa(r.PerPage))
+		h.Set("X-Total-Count", strconv.FormatInt(r.Total, 10))
+	case CursorResponse:
+		h.Set("X-Limit", strconv.Itoa(r.Limit))
+		if r.NextCursor != "" {
+			h.Set("X-Next-Cursor", r.NextCursor)
+		}
+		if r.PrevCursor != "" {
+			h.Set("X-Prev-Cursor", r.PrevCursor)
+		}
+	}
+}
+
+// fromJSONNumbers replaces the json.Number values of a document made by
+// toGeneric with integers, or floats when they are not integral.
+func fromJSONNumbers(v any) any {
+	switch value := v.(type) {
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return i
+		}
+		if u, err := strconv.ParseUint(string(value), 10, 64); err == nil {
+			return u
+		}
+		f, _ := value.Float64()
+		return f
+	case []any:
+		for i, item := range value {
+			value[i] = fromJSONNumbers(item)
+		}
+	case map[string]any:
+		for k, item := range value {
+			value[k] = fromJSONNumbers(item)
+		}
+	}
+	return v
+}
+
+// toGeneric converts v to the maps, slices and scalars its json encoding
+// decodes to, so formats without their own struct mapping honor json tags.
+func toGeneric(v any) (any, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var g any
+	err = d.Decode(&g)
+	return g, err
+}
@@ -0,0 +1,213 @@
+package echoserver
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aliworkshop/errors"
+	"github.com/aliworkshop/gateway/v2"
+)
+
+const envelopeKey = "_echoserver.envelope"
+
+const (
+	EnvelopeBare    = "bare"
+	EnvelopeItems   = "items"
+	EnvelopeJSONAPI = "jsonapi"
+	EnvelopeHAL     = "hal"
+)
+
+// EnvelopeMeta is the metadata of a response handed to envelopes.
+type EnvelopeMeta struct {
+	RequestUUID string
+	// Self is the uri of the request.
+	Self string
+	// List reports whether the result is a collection.
+	List bool
+	// Cursor reports whether the request is cursor paginated, in which case
+	// Limit and the cursors are set instead of Page, PageSize and Total.
+	Cursor     bool
+	Page       int
+	PageSize   int
+	Total      int64
+	Limit      int
+	NextCursor string
+	PrevCursor string
+	// Links holds the uris of the first, prev, next and last pages.
+	Links map[string]string
+}
+
+// Envelope wraps the result of a handler into the body of its response.
+type Envelope interface {
+	Wrap(result any, meta EnvelopeMeta) any
+}
+
+type EnvelopeFunc func(result any, meta EnvelopeMeta) any
+
+func (f EnvelopeFunc) Wrap(result any, meta EnvelopeMeta) any {
+	return f(result, meta)
+}
+
+var (
+	envelopes = map[string]Envelope{
+		EnvelopeBare:    EnvelopeFunc(bareEnvelope),
+		EnvelopeItems:   EnvelopeFunc(itemsEnvelope),
+		EnvelopeJSONAPI: EnvelopeFunc(jsonAPIEnvelope),
+		EnvelopeHAL:     EnvelopeFunc(halEnvelope),
+	}
+	envelopesMtx sync.RWMutex
+)
+
+// RegisterEnvelope makes an envelope available to Http.Envelope and
+// RouterGroup.Envelope. Registering an existing name replaces its envelope.
+func RegisterEnvelope(name string, envelope Envelope) {
+	envelopesMtx.Lock()
+	defer envelopesMtx.Unlock()
+	envelopes[strings.ToLower(name)] = envelope
+}
+
+func getEnvelope(name string) (Envelope, bool) {
+	envelopesMtx.RLock()
+	defer envelopesMtx.RUnlock()
+	e, ok := envelopes[strings.ToLower(name)]
+	return e, ok
+}
+
+// envelopeSelector picks the envelope of the routes of a router group.
+type envelopeSelector struct {
+	live *liveConfig
+	name *groupSetting[string]
+}
+
+func newEnvelopeSelector(live *liveConfig, parent *envelopeSelector) *envelopeSelector {
+	s := &envelopeSelector{live: live}
+	if parent != nil {
+		s.name = newGroupSetting(parent.name)
+	} else {
+		s.name = newGroupSetting[string](nil)
+	}
+	return s
+}
+
+func (s *envelopeSelector) Handle(req gateway.HttpRequester) (any, errors.ErrorModel) {
+	name, ok := s.name.get()
+	if !ok {
+		name = s.live.Load().Envelope
+	}
+	if name != "" {
+		req.SetKey(envelopeKey, name)
+	}
+	return nil, nil
+}
+
+// wrapResult wraps result with the envelope selected for the request, the
+// items envelope by default. stable is the same body without the request
+// uuid, so it is equal across requests for the same representation.
+func wrapResult(req gateway.HttpRequester, p gateway.IPaginator, result any, links map[string]string) (body, stable any) {
+	envelope, _ := getEnvelope(EnvelopeItems)
+	if v, ok := req.GetKey(envelopeKey); ok {
+		if e, ok := getEnvelope(fmt.Sprint(v)); ok {
+			envelope = e
+		}
+	}
+	meta := EnvelopeMeta{
+		RequestUUID: req.RequestUUID(),
+		Self:        req.Request().URL.RequestURI(),
+		List:        isList(result),
+		Links:       links,
+	}
+	if cp, ok := p.(*CursorPaginator); ok {
+		meta.Cursor = true
+		meta.Limit = cp.Limit()
+		meta.NextCursor = cp.NextCursor()
+		meta.PrevCursor = cp.PrevCursor()
+	} else {
+		meta.Page = p.GetPage()
+		meta.PageSize = p.GetPageSize()
+		meta.Total = p.Total()
+	}
+	body = envelope.Wrap(result, meta)
+	meta.RequestUUID = ""
+	return body, envelope.Wrap(result, meta)
+}
+
+func bareEnvelope(result any, _ EnvelopeMeta) any {
+	return result
+}
+
+// itemsEnvelope is the gateway.Response envelope, or CursorResponse for
+// cursor paginated requests.
+func itemsEnvelope(result any, meta EnvelopeMeta) any {
+	if meta.Cursor {
+		return CursorResponse{
+			Limit:      meta.Limit,
+			Items:      result,
+			NextCursor: meta.NextCursor,
+			PrevCursor: meta.PrevCursor,
+		}
+	}
+	return gateway.Response{
+		Page:    meta.Page,
+		PerPage: meta.PageSize,
+		Items:   result,
+		Total:   meta.Total,
+	}
+}
+
+// paginationMeta returns the pagination members of list responses.
+func paginationMeta(meta EnvelopeMeta) map[string]any {
+	m := make(map[string]any)
+	switch {
+	case meta.Cursor:
+		m["limit"] = meta.Limit
+		if meta.NextCursor != "" {
+			m["next_cursor"] = meta.NextCursor
+		}
+		if meta.PrevCursor != "" {
+			m["prev_cursor"] = meta.PrevCursor
+		}
+	case meta.List:
+		m["page"] = meta.Page
+		m["page_size"] = meta.PageSize
+		m["total"] = meta.Total
+	}
+	return m
+}
+
+// jsonAPIEnvelope follows the top level document of JSON:API.
+func jsonAPIEnvelope(result any, meta EnvelopeMeta) any {
+	m := paginationMeta(meta)
+	m["request_uuid"] = meta.RequestUUID
+	links := map[string]string{"self": meta.Self}
+	for rel, uri := range meta.Links {
+		links[rel] = uri
+	}
+	return map[string]any{
+		"data":  result,
+		"meta":  m,
+		"links": links,
+	}
+}
+
+// halEnvelope follows HAL: collections are embedded under items, and objects
+// get their links added next to their own members.
+func halEnvelope(result any, meta EnvelopeMeta) any {
+	links := map[string]any{"self": map[string]string{"href": meta.Self}}
+	for rel, uri := range meta.Links {
+		links[rel] = map[string]string{"href": uri}
+	}
+	if !meta.List && !meta.Cursor {
+		if object, err := toGeneric(result); err == nil {
+			if m, ok := object.(map[string]any); ok {
+				m["_links"] = links
+				return m
+			}
+		}
+	}
+	m := paginationMeta(meta)
+	m["request_uuid"] = meta.RequestUUID
+	m["_links"] = links
+	m["_embedded"] = map[string]any{"items": result}
+	return m
+}
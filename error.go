@@ -1,25 +1,163 @@
 package echoserver
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"sync"
 
 	"github.com/aliworkshop/errors"
+	"github.com/labstack/echo/v4"
 )
 
-func getStatusCodeByError(err errors.ErrorModel) int {
-	switch err.Type() {
-	case errors.TypeValidation:
-		return http.StatusBadRequest
-	case errors.TypeNotFound:
-		return http.StatusNotFound
-	case errors.TypeUnAuthorized:
-		return http.StatusUnauthorized
-	case errors.TypeForbidden:
-		return http.StatusForbidden
-	case errors.TypeTooManyRequests:
-		return http.StatusTooManyRequests
-	case errors.TypeDuplicate:
-		return http.StatusConflict
-	}
-	return http.StatusInternalServerError
+// ErrorStatus describes how errors of a type are answered: the http status
+// code and the headers set on the response.
+type ErrorStatus struct {
+	Code    int
+	Headers http.Header
+}
+
+var (
+	errorStatusMap = map[errors.Type]ErrorStatus{
+		errors.TypeValidation: {Code: http.StatusBadRequest},
+		errors.TypeNotFound:   {Code: http.StatusNotFound},
+		errors.TypeUnAuthorized: {
+			Code:    http.StatusUnauthorized,
+			Headers: http.Header{echo.HeaderWWWAuthenticate: {"Bearer"}},
+		},
+		errors.TypeForbidden: {Code: http.StatusForbidden},
+		errors.TypeTooManyRequests: {
+			Code:    http.StatusTooManyRequests,
+			Headers: http.Header{echo.HeaderRetryAfter: {"60"}},
+		},
+		errors.TypeDuplicate:     {Code: http.StatusConflict},
+		errors.TypeInternal:      {Code: http.StatusInternalServerError},
+		TypeMethodNotAllowed:     {Code: http.StatusMethodNotAllowed},
+		TypeRequestTimeout:       {Code: http.StatusRequestTimeout},
+		TypeGone:                 {Code: http.StatusGone},
+		TypePreconditionFailed:   {Code: http.StatusPreconditionFailed},
+		TypeRequestTooLarge:      {Code: http.StatusRequestEntityTooLarge},
+		TypeUnsupportedMediaType: {Code: http.StatusUnsupportedMediaType},
+		TypeUnprocessable:        {Code: http.StatusUnprocessableEntity},
+		TypeLocked:               {Code: http.StatusLocked},
+		TypeFailedDependency:     {Code: http.StatusFailedDependency},
+		TypeUnavailable:          {Code: http.StatusServiceUnavailable},
+		TypeTimeout:              {Code: http.StatusGatewayTimeout},
+	}
+	errorStatusMapMtx sync.RWMutex
+)
+
+// RegisterErrorStatus maps an error type to an http status code and the
+// headers to answer it with. It overrides the built-in mapping of the type.
+func RegisterErrorStatus(typ errors.Type, code int, headers http.Header) {
+	errorStatusMapMtx.Lock()
+	defer errorStatusMapMtx.Unlock()
+	errorStatusMap[typ] = ErrorStatus{Code: code, Headers: headers}
+}
+
+// statusError overrides the http status code of the error it wraps.
+type statusError struct {
+	errors.ErrorModel
+	code int
+}
+
+// WithStatusCode answers err with code regardless of its type.
+func WithStatusCode(err errors.ErrorModel, code int) errors.ErrorModel {
+	return &statusError{ErrorModel: err, code: code}
+}
+
+// Clone, WithMessage and WithProperty keep the status code on the derived
+// error.
+func (e *statusError) Clone() errors.ErrorModel {
+	return &statusError{ErrorModel: e.ErrorModel.Clone(), code: e.code}
+}
+
+func (e *statusError) WithMessage(msg string) errors.ErrorModel {
+	return &statusError{ErrorModel: e.ErrorModel.WithMessage(msg), code: e.code}
+}
+
+func (e *statusError) WithProperty(key string, value any) errors.ErrorModel {
+	return &statusError{ErrorModel: e.ErrorModel.WithProperty(key, value), code: e.code}
+}
+
+func (e *statusError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.ErrorModel)
+}
+
+// typedError is an error of one of the types errors does not define.
+type typedError struct {
+	errors.ErrorModel
+	typ errors.Type
+	id  string
+}
+
+// NewTypedError creates an error of typ, e.g. TypeGone, identified by id.
+// Its message is the one of errs, if any.
+func NewTypedError(typ errors.Type, id string, errs ...error) errors.ErrorModel {
+	return &typedError{ErrorModel: errors.Internal(errs...), typ: typ, id: id}
+}
+
+func (e *typedError) Type() errors.Type {
+	return e.typ
+}
+
+func (e *typedError) Id() string {
+	return e.id
+}
+
+func (e *typedError) Clone() errors.ErrorModel {
+	return &typedError{ErrorModel: e.ErrorModel.Clone(), typ: e.typ, id: e.id}
+}
+
+func (e *typedError) WithMessage(msg string) errors.ErrorModel {
+	return &typedError{ErrorModel: e.ErrorModel.WithMessage(msg), typ: e.typ, id: e.id}
+}
+
+func (e *typedError) WithProperty(key string, value any) errors.ErrorModel {
+	return &typedError{ErrorModel: e.ErrorModel.WithProperty(key, value), typ: e.typ, id: e.id}
+}
+
+// MarshalJSON encodes the wrapped error with its id replaced.
+func (e *typedError) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(e.ErrorModel)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]json.RawMessage
+	if json.Unmarshal(b, &m) != nil {
+		return b, nil
+	}
+	if _, ok := m["id"]; ok {
+		m["id"], _ = json.Marshal(e.id)
+	}
+	return json.Marshal(m)
+}
+
+func getErrorStatus(err errors.ErrorModel) ErrorStatus {
+	errorStatusMapMtx.RLock()
+	es, ok := errorStatusMap[err.Type()]
+	errorStatusMapMtx.RUnlock()
+	if !ok {
+		es.Code = http.StatusInternalServerError
+	}
+	if se, ok := err.(*statusError); ok {
+		es.Code = se.code
+	}
+	return es
+}
+
+// setErrorHeaders sets the headers registered for the type of err. A
+// retry_after property of the error takes precedence over the registered
+// Retry-After value.
+func setErrorHeaders(ctx echo.Context, es ErrorStatus, err errors.ErrorModel) {
+	header := ctx.Response().Header()
+	for k, values := range es.Headers {
+		header.Del(k)
+		for _, v := range values {
+			header.Add(k, v)
+		}
+	}
+	if v, ok := err.Properties()["retry_after"]; ok && (es.Code == http.StatusTooManyRequests || es.Code == http.StatusServiceUnavailable) {
+		header.Set(echo.HeaderRetryAfter, fmt.Sprint(v))
+	}
 }
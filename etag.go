@@ -0,0 +1,164 @@
+package echoserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aliworkshop/errors"
+	"github.com/aliworkshop/gateway/v2"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	etagKey         = "_echoserver.etag"
+	lastModifiedKey = "_echoserver.last_modified"
+)
+
+// formatETag quotes etag, prefixed with W/ when weak. Quoted etags are kept
+// as they are.
+func formatETag(etag string, weak bool) string {
+	if !strings.HasPrefix(etag, `"`) && !strings.HasPrefix(etag, `W/"`) {
+		etag = `"` + etag + `"`
+	}
+	if weak && !strings.HasPrefix(etag, "W/") {
+		etag = "W/" + etag
+	}
+	return etag
+}
+
+// codingETag derives the tag of a representation compressed with coding
+// from the tag of the uncompressed one, e.g. "v1" becomes "v1-gzip", so
+// strong tags stay strong and distinct per coding.
+func codingETag(etag, coding string) string {
+	trimmed, ok := strings.CutSuffix(etag, `"`)
+	if !ok {
+		return etag
+	}
+	return trimmed + "-" + coding + `"`
+}
+
+// stripETagCoding turns a tag made by codingETag back into the tag of the
+// uncompressed representation.
+func stripETagCoding(etag string) string {
+	trimmed, ok := strings.CutSuffix(etag, `"`)
+	if !ok {
+		return etag
+	}
+	i := strings.LastIndexByte(trimmed, '-')
+	if i < 0 {
+		return etag
+	}
+	if _, ok := getCompressor(trimmed[i+1:]); !ok {
+		return etag
+	}
+	return trimmed[:i] + `"`
+}
+
+// etagMatches reports whether etag is listed in an If-Match or If-None-Match
+// header. Weak comparison ignores the W/ prefix of both sides. Tags the
+// compression middleware derived from etag match it as well.
+func etagMatches(header, etag string, weak bool) bool {
+	if strings.TrimSpace(header) == "*" {
+		return etag != ""
+	}
+	if weak {
+		etag = strings.TrimPrefix(etag, "W/")
+	} else if strings.HasPrefix(etag, "W/") {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag || stripETagCoding(candidate) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *request) SetETag(etag string, weak bool) {
+	r.SetKey(etagKey, formatETag(etag, weak))
+}
+
+func (r *request) SetLastModified(t time.Time) {
+	r.SetKey(lastModifiedKey, t.UTC().Truncate(time.Second))
+}
+
+func (r *request) CheckPreconditions(etag string, lastModified time.Time) errors.ErrorModel {
+	if ifMatch := r.GetHeader("If-Match"); ifMatch != "" {
+		if etag == "" || !etagMatches(ifMatch, formatETag(etag, false), false) {
+			return preconditionFailed("If-Match")
+		}
+		return nil
+	}
+	if since, err := http.ParseTime(r.GetHeader("If-Unmodified-Since")); err == nil && !lastModified.IsZero() {
+		if lastModified.Truncate(time.Second).After(since) {
+			return preconditionFailed("If-Unmodified-Since")
+		}
+	}
+	return nil
+}
+
+func preconditionFailed(header string) errors.ErrorModel {
+	err := fmt.Errorf("%s precondition failed", header)
+	return NewTypedError(TypePreconditionFailed, "precondition_failed", err).WithProperty("error", err.Error())
+}
+
+// respondConditional answers successful READ responses with an ETag, the one
+// set by the handler or a weak one computed from stable, the encoded body
+// without per-request metadata, and with 304 Not Modified when the client
+// already has the representation.
+func respondConditional(ctx echo.Context, req gateway.HttpRequester, code int, body, stable any) error {
+	etag, _ := req.GetKey(etagKey)
+	lastModified, _ := req.GetKey(lastModifiedKey)
+	header := ctx.Response().Header()
+	if t, ok := lastModified.(time.Time); ok {
+		header.Set(echo.HeaderLastModified, t.Format(http.TimeFormat))
+	}
+
+	method := ctx.Request().Method
+	if code != http.StatusOK || method != http.MethodGet && method != http.MethodHead {
+		if etag != nil {
+			header.Set("ETag", etag.(string))
+		}
+		return respondNegotiated(ctx, code, body)
+	}
+
+	mediaType, b, err := encodeNegotiated(ctx, body)
+	if err != nil {
+		return respondNegotiated(ctx, code, body)
+	}
+	header.Add(echo.HeaderVary, echo.HeaderAccept)
+	if etag == nil {
+		sb := b
+		if _, encoded, err := encodeNegotiated(ctx, stable); err == nil {
+			sb = encoded
+		}
+		sum := sha256.Sum256(append([]byte(mediaType), sb...))
+		etag = formatETag(hex.EncodeToString(sum[:16]), true)
+	}
+	header.Set("ETag", etag.(string))
+
+	if notModified(ctx.Request(), etag.(string), lastModified) {
+		return ctx.NoContent(http.StatusNotModified)
+	}
+	return ctx.Blob(code, mediaType, b)
+}
+
+func notModified(r *http.Request, etag string, lastModified any) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		return etagMatches(ifNoneMatch, etag, true)
+	}
+	t, ok := lastModified.(time.Time)
+	if !ok {
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !t.After(since)
+}
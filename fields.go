@@ -0,0 +1,158 @@
+package echoserver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aliworkshop/errors"
+	"github.com/aliworkshop/gateway/v2"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	fieldsProjectionKey = "_echoserver.fields_projection"
+	fieldsProjectedKey  = "_echoserver.fields_projected"
+)
+
+// fieldTree is a set of json paths, e.g. id and owner.email, keyed by their
+// first segment.
+type fieldTree map[string]fieldTree
+
+// ParseFields reads a comma separated list of dotted json paths.
+func ParseFields(s string) []string {
+	var paths []string
+	for _, path := range strings.Split(s, ",") {
+		if path = strings.Trim(strings.TrimSpace(path), "."); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+func newFieldTree(paths []string) fieldTree {
+	tree := make(fieldTree)
+	for _, path := range paths {
+		node := tree
+		for _, segment := range strings.Split(path, ".") {
+			child, ok := node[segment]
+			if !ok {
+				child = make(fieldTree)
+				node[segment] = child
+			}
+			node = child
+		}
+	}
+	return tree
+}
+
+// project keeps the members of the objects in v listed by the tree. A path
+// ending on an object keeps the whole object, and arrays are projected
+// element by element.
+func (t fieldTree) project(v any) any {
+	switch value := v.(type) {
+	case map[string]any:
+		projected := make(map[string]any, len(t))
+		for k, sub := range t {
+			member, ok := value[k]
+			if !ok {
+				continue
+			}
+			if len(sub) > 0 {
+				member = sub.project(member)
+			}
+			projected[k] = member
+		}
+		return projected
+	case []any:
+		projected := make([]any, len(value))
+		for i, item := range value {
+			projected[i] = t.project(item)
+		}
+		return projected
+	}
+	return v
+}
+
+// FieldsConfig configures the sparse fieldsets of a route.
+type FieldsConfig struct {
+	// Allowed are the paths clients may select. Allowing a path allows every
+	// path below it, so owner allows owner.email.
+	Allowed []string
+}
+
+type fieldsHandler struct {
+	allowed fieldTree
+}
+
+// NewFieldsHandler returns a handler checking the $fields query parameter of
+// requests against the allowed paths. Only routes with it project their
+// responses.
+func NewFieldsHandler(cfg FieldsConfig) gateway.Handler {
+	return &fieldsHandler{allowed: newFieldTree(cfg.Allowed)}
+}
+
+func (h *fieldsHandler) Handle(req gateway.HttpRequester) (any, errors.ErrorModel) {
+	paths := ParseFields(req.GetQuery("$fields"))
+	var fieldErrors []FieldError
+	for _, path := range paths {
+		if !h.allows(path) {
+			fieldErrors = append(fieldErrors, FieldError{
+				Field:   "$fields",
+				Tag:     "fields",
+				Param:   path,
+				Message: fmt.Sprintf("selecting %s is not allowed", path),
+			})
+		}
+	}
+	if len(fieldErrors) > 0 {
+		err := fmt.Errorf("invalid fields")
+		return nil, errors.Validation(err).WithProperty("error", err.Error()).WithProperty("fields", fieldErrors)
+	}
+	if len(paths) > 0 {
+		req.SetKey(fieldsProjectionKey, newFieldTree(paths))
+	}
+	return nil, nil
+}
+
+func (h *fieldsHandler) allows(path string) bool {
+	node := h.allowed
+	for _, segment := range strings.Split(path, ".") {
+		child, ok := node[segment]
+		if !ok {
+			return false
+		}
+		if len(child) == 0 {
+			return true
+		}
+		node = child
+	}
+	return true
+}
+
+// projectFields applies the $fields of the request to result. It returns
+// result untouched when the route has no fields allowlist or the request
+// selects no fields. Projected results are marked on the context, so only
+// encoders able to represent them are negotiated.
+func projectFields(req gateway.HttpRequester, result any) any {
+	v, ok := req.GetKey(fieldsProjectionKey)
+	if !ok || result == nil {
+		return result
+	}
+	tree, _ := v.(fieldTree)
+	if len(tree) == 0 {
+		return result
+	}
+	generic, err := toGeneric(result)
+	if err != nil {
+		return result
+	}
+	req.GetHttpContext().(echo.Context).Set(fieldsProjectedKey, true)
+	return tree.project(generic)
+}
+
+// encodesMaps reports whether encoder can represent a projected result.
+// Protobuf encodes proto messages only.
+func encodesMaps(encoder Encoder) bool {
+	_, ok := encoder.(protobufEncoder)
+	return !ok
+}
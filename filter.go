@@ -0,0 +1,305 @@
+package echoserver
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aliworkshop/dfilter"
+	"github.com/aliworkshop/errors"
+	"github.com/aliworkshop/gateway/v2"
+)
+
+const filterConditionsKey = "_echoserver.filter_conditions"
+
+const (
+	FilterEq     = "eq"
+	FilterNe     = "ne"
+	FilterGt     = "gt"
+	FilterGte    = "gte"
+	FilterLt     = "lt"
+	FilterLte    = "lte"
+	FilterIn     = "in"
+	FilterNin    = "nin"
+	FilterLike   = "like"
+	FilterIsNull = "isnull"
+)
+
+type FilterType int
+
+const (
+	FilterString FilterType = iota
+	FilterInt
+	FilterFloat
+	FilterBool
+	// FilterTime values are RFC 3339 timestamps or dates.
+	FilterTime
+)
+
+var defaultFilterOperators = map[FilterType][]string{
+	FilterString: {FilterEq, FilterNe, FilterIn, FilterNin, FilterLike, FilterIsNull},
+	FilterInt:    {FilterEq, FilterNe, FilterGt, FilterGte, FilterLt, FilterLte, FilterIn, FilterNin, FilterIsNull},
+	FilterFloat:  {FilterEq, FilterNe, FilterGt, FilterGte, FilterLt, FilterLte, FilterIn, FilterNin, FilterIsNull},
+	FilterBool:   {FilterEq, FilterNe, FilterIsNull},
+	FilterTime:   {FilterEq, FilterNe, FilterGt, FilterGte, FilterLt, FilterLte, FilterIsNull},
+}
+
+// FilterField allows filtering on a field of a route.
+type FilterField struct {
+	// Name is the name of the field in the query string.
+	Name string
+	// Column is the name handed to the filters, Name by default.
+	Column string
+	Type   FilterType
+	// Operators are the allowed operators, all operators of the type when
+	// empty.
+	Operators []string
+}
+
+// FilterCondition is a single parsed filter. Value holds a []any for the in
+// and nin operators.
+type FilterCondition struct {
+	Field    string
+	Operator string
+	Value    any
+}
+
+// RawFilter is a filter read from the query string before its field and
+// operator are checked and its values coerced.
+type RawFilter struct {
+	Field    string
+	Operator string
+	Values   []string
+}
+
+// FilterParser reads the filters of a query string.
+type FilterParser func(query url.Values) ([]RawFilter, error)
+
+// FilterConverter turns parsed conditions into the dynamic filters of a
+// request.
+type FilterConverter func(conditions []FilterCondition) ([]dfilter.Filter, error)
+
+var (
+	filterConverter    FilterConverter
+	filterConverterMtx sync.RWMutex
+)
+
+// RegisterFilterConverter overrides the converter used by filter handlers
+// without a converter of their own. ConvertFilters is used when none is
+// registered.
+func RegisterFilterConverter(converter FilterConverter) {
+	filterConverterMtx.Lock()
+	defer filterConverterMtx.Unlock()
+	filterConverter = converter
+}
+
+func getFilterConverter() FilterConverter {
+	filterConverterMtx.RLock()
+	defer filterConverterMtx.RUnlock()
+	return filterConverter
+}
+
+// ConvertFilters turns each condition into a dfilter.Filter on its column
+// with the same operator and value.
+func ConvertFilters(conditions []FilterCondition) ([]dfilter.Filter, error) {
+	filters := make([]dfilter.Filter, 0, len(conditions))
+	for _, c := range conditions {
+		filters = append(filters, dfilter.Filter{Field: c.Field, Op: c.Operator, Value: c.Value})
+	}
+	return filters, nil
+}
+
+// ParseBracketFilters reads filters written as field[op]=value, e.g.
+// price[gte]=10&status[in]=a,b. A plain field=value is an eq filter. Query
+// parameters starting with $ are reserved and skipped.
+func ParseBracketFilters(query url.Values) ([]RawFilter, error) {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	filters := make([]RawFilter, 0, len(keys))
+	for _, k := range keys {
+		if strings.HasPrefix(k, "$") {
+			continue
+		}
+		field, op := k, FilterEq
+		if i := strings.IndexByte(k, '['); i >= 0 {
+			if !strings.HasSuffix(k, "]") || i == 0 {
+				return nil, fmt.Errorf("invalid filter %q", k)
+			}
+			field, op = k[:i], strings.ToLower(k[i+1:len(k)-1])
+		}
+		filters = append(filters, RawFilter{Field: field, Operator: op, Values: query[k]})
+	}
+	return filters, nil
+}
+
+// FilterConfig configures the filters of a route.
+type FilterConfig struct {
+	Fields []FilterField
+	// Parser defaults to ParseBracketFilters.
+	Parser FilterParser
+	// Converter overrides the one set by RegisterFilterConverter, which
+	// defaults to ConvertFilters.
+	Converter FilterConverter
+}
+
+type filterHandler struct {
+	fields    map[string]FilterField
+	parser    FilterParser
+	converter FilterConverter
+}
+
+// NewFilterHandler returns a handler parsing the query string of requests
+// into filter conditions and then into the dynamic filters of the request.
+// Filtering on a field or with an operator that is not allowed is answered
+// with a validation error. Plain field=value parameters of fields that are
+// not allowed are left alone, as they may be ordinary query parameters of
+// the route.
+func NewFilterHandler(cfg FilterConfig) gateway.Handler {
+	h := &filterHandler{
+		fields:    make(map[string]FilterField, len(cfg.Fields)),
+		parser:    cfg.Parser,
+		converter: cfg.Converter,
+	}
+	for _, f := range cfg.Fields {
+		if f.Column == "" {
+			f.Column = f.Name
+		}
+		if len(f.Operators) == 0 {
+			f.Operators = defaultFilterOperators[f.Type]
+		}
+		h.fields[f.Name] = f
+	}
+	if h.parser == nil {
+		h.parser = ParseBracketFilters
+	}
+	return h
+}
+
+func (h *filterHandler) Handle(req gateway.HttpRequester) (any, errors.ErrorModel) {
+	query := req.Request().URL.Query()
+	raws, err := h.parser(query)
+	if err != nil {
+		return nil, errors.Validation(err).WithProperty("error", err.Error())
+	}
+
+	conditions := make([]FilterCondition, 0, len(raws))
+	var fieldErrors []FieldError
+	for _, raw := range raws {
+		field, ok := h.fields[raw.Field]
+		if !ok {
+			if _, plain := query[raw.Field]; plain && raw.Operator == FilterEq {
+				continue
+			}
+			fieldErrors = append(fieldErrors, filterError(raw, "filter", "filtering on %s is not allowed"))
+			continue
+		}
+		if !slices.Contains(field.Operators, raw.Operator) {
+			fieldErrors = append(fieldErrors, filterError(raw, "operator", "operator %s is not allowed on %s"))
+			continue
+		}
+		value, err := coerceFilter(field.Type, raw)
+		if err != nil {
+			fieldErrors = append(fieldErrors, FieldError{
+				Field:   raw.Field,
+				Tag:     "type",
+				Param:   raw.Operator,
+				Message: err.Error(),
+			})
+			continue
+		}
+		conditions = append(conditions, FilterCondition{Field: field.Column, Operator: raw.Operator, Value: value})
+	}
+	if len(fieldErrors) > 0 {
+		err := fmt.Errorf("invalid filters")
+		return nil, errors.Validation(err).WithProperty("error", err.Error()).WithProperty("fields", fieldErrors)
+	}
+	req.SetKey(filterConditionsKey, conditions)
+
+	converter := h.converter
+	if converter == nil {
+		converter = getFilterConverter()
+	}
+	if converter == nil {
+		converter = ConvertFilters
+	}
+	filters, err := converter(conditions)
+	if err != nil {
+		return nil, errors.Validation(err).WithProperty("error", err.Error())
+	}
+	req.SetDynamicFilters(append(req.GetDynamicFilters(), filters...))
+	return nil, nil
+}
+
+// FilterConditions returns the conditions parsed by the filter handler of the
+// route.
+func FilterConditions(req gateway.HttpRequester) []FilterCondition {
+	v, _ := req.GetKey(filterConditionsKey)
+	conditions, _ := v.([]FilterCondition)
+	return conditions
+}
+
+func filterError(raw RawFilter, tag, format string) FieldError {
+	message := fmt.Sprintf(format, raw.Field)
+	if tag == "operator" {
+		message = fmt.Sprintf(format, raw.Operator, raw.Field)
+	}
+	return FieldError{Field: raw.Field, Tag: tag, Param: raw.Operator, Message: message}
+}
+
+func coerceFilter(typ FilterType, raw RawFilter) (any, error) {
+	if len(raw.Values) == 0 {
+		return nil, fmt.Errorf("%s needs a value", raw.Field)
+	}
+	switch raw.Operator {
+	case FilterIsNull:
+		return strconv.ParseBool(raw.Values[0])
+	case FilterIn, FilterNin:
+		var values []any
+		for _, v := range raw.Values {
+			for _, part := range strings.Split(v, ",") {
+				value, err := coerceFilterValue(typ, raw.Field, part)
+				if err != nil {
+					return nil, err
+				}
+				values = append(values, value)
+			}
+		}
+		return values, nil
+	}
+	return coerceFilterValue(typ, raw.Field, raw.Values[0])
+}
+
+func coerceFilterValue(typ FilterType, field, s string) (any, error) {
+	var (
+		v   any
+		err error
+	)
+	switch typ {
+	case FilterInt:
+		v, err = strconv.ParseInt(s, 10, 64)
+	case FilterFloat:
+		v, err = strconv.ParseFloat(s, 64)
+	case FilterBool:
+		v, err = strconv.ParseBool(s)
+	case FilterTime:
+		v, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			v, err = time.Parse(time.DateOnly, s)
+		}
+	default:
+		v = s
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q for %s", s, field)
+	}
+	return v, nil
+}
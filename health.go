@@ -0,0 +1,175 @@
+package echoserver
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aliworkshop/gateway/v2"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	HealthUp       = "up"
+	HealthDegraded = "degraded"
+	HealthDown     = "down"
+)
+
+// HealthChecker reports whether a dependency of the service is usable.
+type HealthChecker interface {
+	Name() string
+	Check(ctx context.Context) error
+}
+
+type healthCheckerFunc struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+func (h healthCheckerFunc) Name() string                    { return h.name }
+func (h healthCheckerFunc) Check(ctx context.Context) error { return h.check(ctx) }
+
+// HealthCheckerFunc adapts a function to a HealthChecker.
+func HealthCheckerFunc(name string, check func(ctx context.Context) error) HealthChecker {
+	return healthCheckerFunc{name: name, check: check}
+}
+
+type HealthCheckOptions struct {
+	// Timeout bounds a single run of the check, defaults to Http.Health.Timeout.
+	Timeout time.Duration
+	// CacheTTL reuses the last result for the given duration.
+	CacheTTL time.Duration
+	// Critical checks make the service unready when they fail, the others
+	// only degrade it.
+	Critical bool
+}
+
+type HealthResult struct {
+	Name      string    `json:"name"`
+	Status    string    `json:"status"`
+	Critical  bool      `json:"critical"`
+	Error     string    `json:"error,omitempty"`
+	Elapsed   int64     `json:"elapsed"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+type HealthReport struct {
+	Status string         `json:"status"`
+	Checks []HealthResult `json:"checks,omitempty"`
+}
+
+type healthCheck struct {
+	checker HealthChecker
+	options HealthCheckOptions
+
+	mtx  sync.Mutex
+	last *HealthResult
+}
+
+func (hc *healthCheck) run(ctx context.Context) HealthResult {
+	hc.mtx.Lock()
+	defer hc.mtx.Unlock()
+	if hc.last != nil && hc.options.CacheTTL > 0 && time.Since(hc.last.CheckedAt) < hc.options.CacheTTL {
+		return *hc.last
+	}
+
+	if hc.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, hc.options.Timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- hc.checker.Check(ctx) }()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	result := HealthResult{
+		Name:      hc.checker.Name(),
+		Status:    HealthUp,
+		Critical:  hc.options.Critical,
+		Elapsed:   time.Since(start).Milliseconds(),
+		CheckedAt: start,
+	}
+	if err != nil {
+		result.Status = HealthDown
+		result.Error = err.Error()
+	}
+	hc.last = &result
+	return result
+}
+
+type healthRegistry struct {
+	mtx    sync.RWMutex
+	checks []*healthCheck
+}
+
+func (hr *healthRegistry) add(checker HealthChecker, options HealthCheckOptions) {
+	hr.mtx.Lock()
+	defer hr.mtx.Unlock()
+	hr.checks = append(hr.checks, &healthCheck{checker: checker, options: options})
+}
+
+// report runs every check concurrently and aggregates their results.
+func (hr *healthRegistry) report(ctx context.Context) HealthReport {
+	hr.mtx.RLock()
+	checks := append([]*healthCheck(nil), hr.checks...)
+	hr.mtx.RUnlock()
+
+	results := make([]HealthResult, len(checks))
+	var wg sync.WaitGroup
+	for i, hc := range checks {
+		wg.Add(1)
+		go func(i int, hc *healthCheck) {
+			defer wg.Done()
+			results[i] = hc.run(ctx)
+		}(i, hc)
+	}
+	wg.Wait()
+
+	report := HealthReport{Status: HealthUp, Checks: results}
+	for _, r := range results {
+		if r.Status == HealthUp {
+			continue
+		}
+		if r.Critical {
+			report.Status = HealthDown
+			break
+		}
+		report.Status = HealthDegraded
+	}
+	return report
+}
+
+func (es *echoServer) AddHealthChecker(checker HealthChecker, options HealthCheckOptions) {
+	if options.Timeout == 0 {
+		options.Timeout = es.live.Load().Health.Timeout
+	}
+	es.health.add(checker, options)
+}
+
+func (es *echoServer) mountHealth(e *echo.Echo, path string) {
+	e.GET(path+"/live", es.liveHandler)
+	e.GET(path+"/ready", es.readyHandler)
+}
+
+func (es *echoServer) liveHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, gateway.Response{Items: HealthReport{Status: HealthUp}})
+}
+
+func (es *echoServer) readyHandler(c echo.Context) error {
+	if !es.ready.Load() {
+		return c.JSON(http.StatusServiceUnavailable, gateway.Response{Items: HealthReport{Status: HealthDown}})
+	}
+	report := es.health.report(c.Request().Context())
+	status := http.StatusOK
+	if report.Status == HealthDown {
+		status = http.StatusServiceUnavailable
+	}
+	return c.JSON(status, gateway.Response{Items: report})
+}
@@ -0,0 +1,213 @@
+package echoserver
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricLabelRoute   = "route"
+	metricLabelMethod  = "method"
+	metricLabelStatus  = "status"
+	metricLabelCode    = "code"
+	metricLabelService = "service"
+	metricLabelHost    = "host"
+	metricLabelURL     = "url"
+)
+
+type MetricsConfig struct {
+	Namespace string
+	Subsystem string
+	Path      string
+	// Buckets are the request duration buckets in seconds.
+	Buckets []float64
+	// SizeBuckets are the request and response size buckets in bytes.
+	SizeBuckets []float64
+	// Labels is a subset of route, method, status (the status class, e.g.
+	// 2xx), code, service, host and url. url is the route template under the
+	// name echo-contrib used, and host is only set on requests_total, as
+	// echo-contrib did. The default is code, method, host and url, the labels
+	// of the echo-contrib metrics the server exposed before.
+	Labels []string
+}
+
+type httpMetrics struct {
+	labels []string
+	// histogram holds the indexes of the labels the histograms carry.
+	histogram []int
+	requests  *prometheus.CounterVec
+	duration  *prometheus.HistogramVec
+	reqSize   *prometheus.HistogramVec
+	resSize   *prometheus.HistogramVec
+	inFlight  prometheus.Gauge
+}
+
+func newHttpMetrics(c MetricsConfig, serviceName string) (*httpMetrics, error) {
+	var constLabels prometheus.Labels
+	var labels, histogramLabels []string
+	m := &httpMetrics{}
+	for _, l := range c.Labels {
+		switch l {
+		case metricLabelService:
+			if serviceName != "" {
+				constLabels = prometheus.Labels{metricLabelService: serviceName}
+			}
+		case metricLabelRoute, metricLabelMethod, metricLabelStatus, metricLabelCode, metricLabelURL:
+			m.histogram = append(m.histogram, len(labels))
+			histogramLabels = append(histogramLabels, l)
+			labels = append(labels, l)
+		case metricLabelHost:
+			labels = append(labels, l)
+		default:
+			return nil, fmt.Errorf("metrics: unknown label %s", l)
+		}
+	}
+	m.labels = labels
+
+	var err error
+	if m.requests, err = registerCollector(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   c.Namespace,
+		Subsystem:   c.Subsystem,
+		Name:        "requests_total",
+		Help:        "How many HTTP requests processed.",
+		ConstLabels: constLabels,
+	}, labels)); err != nil {
+		return nil, err
+	}
+	if m.duration, err = registerCollector(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:   c.Namespace,
+		Subsystem:   c.Subsystem,
+		Name:        "request_duration_seconds",
+		Help:        "The HTTP request latencies in seconds.",
+		Buckets:     c.Buckets,
+		ConstLabels: constLabels,
+	}, histogramLabels)); err != nil {
+		return nil, err
+	}
+	if m.reqSize, err = registerCollector(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:   c.Namespace,
+		Subsystem:   c.Subsystem,
+		Name:        "request_size_bytes",
+		Help:        "The HTTP request sizes in bytes.",
+		Buckets:     c.SizeBuckets,
+		ConstLabels: constLabels,
+	}, histogramLabels)); err != nil {
+		return nil, err
+	}
+	if m.resSize, err = registerCollector(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:   c.Namespace,
+		Subsystem:   c.Subsystem,
+		Name:        "response_size_bytes",
+		Help:        "The HTTP response sizes in bytes.",
+		Buckets:     c.SizeBuckets,
+		ConstLabels: constLabels,
+	}, histogramLabels)); err != nil {
+		return nil, err
+	}
+	if m.inFlight, err = registerCollector(prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   c.Namespace,
+		Subsystem:   c.Subsystem,
+		Name:        "requests_in_flight",
+		Help:        "The number of HTTP requests being served.",
+		ConstLabels: constLabels,
+	})); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// registerCollector registers c in the default registry, reusing the already
+// registered collector when the same metric was registered before.
+func registerCollector[T prometheus.Collector](c T) (T, error) {
+	if err := prometheus.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			if existing, ok := are.ExistingCollector.(T); ok {
+				return existing, nil
+			}
+		}
+		return c, err
+	}
+	return c, nil
+}
+
+func (m *httpMetrics) middleware(metricsPath string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if c.Path() == metricsPath {
+				return next(c)
+			}
+			m.inFlight.Inc()
+			defer m.inFlight.Dec()
+			start := time.Now()
+			err := next(c)
+
+			status := c.Response().Status
+			if err != nil {
+				status = http.StatusInternalServerError
+				if he, ok := err.(*echo.HTTPError); ok {
+					status = he.Code
+				}
+			}
+			values := make([]string, len(m.labels))
+			for i, l := range m.labels {
+				switch l {
+				case metricLabelRoute, metricLabelURL:
+					values[i] = c.Path()
+				case metricLabelHost:
+					values[i] = c.Request().Host
+				case metricLabelMethod:
+					values[i] = c.Request().Method
+				case metricLabelStatus:
+					values[i] = strconv.Itoa(status/100) + "xx"
+				case metricLabelCode:
+					values[i] = strconv.Itoa(status)
+				}
+			}
+			histogramValues := make([]string, len(m.histogram))
+			for i, j := range m.histogram {
+				histogramValues[i] = values[j]
+			}
+			m.requests.WithLabelValues(values...).Inc()
+			m.duration.WithLabelValues(histogramValues...).Observe(time.Since(start).Seconds())
+			if size := c.Request().ContentLength; size >= 0 {
+				m.reqSize.WithLabelValues(histogramValues...).Observe(float64(size))
+			}
+			m.resSize.WithLabelValues(histogramValues...).Observe(float64(c.Response().Size))
+			return err
+		}
+	}
+}
+
+func metricsHandler() echo.HandlerFunc {
+	return echo.WrapHandler(promhttp.Handler())
+}
+
+func (c *MetricsConfig) initialize() {
+	if c.Subsystem == "" {
+		c.Subsystem = "app"
+	}
+	if c.Path == "" {
+		c.Path = "/monitoring/metrics"
+	} else if !strings.HasPrefix(c.Path, "/") {
+		// Routes match with a leading slash, so the middleware would
+		// otherwise record the scrapes of the metrics endpoint.
+		c.Path = "/" + c.Path
+	}
+	if len(c.Buckets) == 0 {
+		c.Buckets = prometheus.DefBuckets
+	}
+	if len(c.SizeBuckets) == 0 {
+		// The buckets of the echo-contrib size histograms.
+		c.SizeBuckets = []float64{1 << 10, 2 << 10, 5 << 10, 10 << 10, 100 << 10, 500 << 10, 1 << 20, 2.5 * (1 << 20), 5 << 20, 10 << 20}
+	}
+	if len(c.Labels) == 0 {
+		c.Labels = []string{metricLabelCode, metricLabelMethod, metricLabelHost, metricLabelURL}
+	}
+}
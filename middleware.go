@@ -0,0 +1,245 @@
+package echoserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	ew "github.com/labstack/echo/v4/middleware"
+	"golang.org/x/time/rate"
+)
+
+// MiddlewareFactory builds a middleware from the raw Config value of an entry
+// in the middlewares section of the server config.
+type MiddlewareFactory func(config any) (echo.MiddlewareFunc, error)
+
+var (
+	middlewareFactories = map[string]MiddlewareFactory{
+		"cors":       corsMiddleware,
+		"gzip":       gzipMiddleware,
+		"ratelimit":  rateLimitMiddleware,
+		"bodylimit":  bodyLimitMiddleware,
+		"timeout":    timeoutMiddleware,
+		"secure":     secureMiddleware,
+		"requestid":  requestIdMiddleware,
+		"recover":    recoverMiddleware,
+		"decompress": decompressMiddleware,
+	}
+	middlewareFactoriesMtx sync.RWMutex
+)
+
+// RegisterMiddleware makes a middleware type available to the middlewares
+// section of the config. Registering an existing type replaces its factory.
+func RegisterMiddleware(typ string, factory MiddlewareFactory) {
+	middlewareFactoriesMtx.Lock()
+	defer middlewareFactoriesMtx.Unlock()
+	middlewareFactories[strings.ToLower(typ)] = factory
+}
+
+func getMiddlewareFactory(typ string) (MiddlewareFactory, bool) {
+	middlewareFactoriesMtx.RLock()
+	defer middlewareFactoriesMtx.RUnlock()
+	f, ok := middlewareFactories[strings.ToLower(typ)]
+	return f, ok
+}
+
+// DecodeMiddlewareConfig decodes the raw Config value of a middleware entry
+// into out, which should be a pointer to a struct.
+func DecodeMiddlewareConfig(config any, out any) error {
+	if config == nil {
+		return nil
+	}
+	b, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
+// buildMiddlewares instantiates every configured middleware by name.
+func buildMiddlewares(mc middlewareConfig) (map[string]echo.MiddlewareFunc, error) {
+	mfs := make(map[string]echo.MiddlewareFunc, len(mc.Middlewares))
+	for name, m := range mc.Middlewares {
+		factory, ok := getMiddlewareFactory(m.Type)
+		if !ok {
+			return nil, fmt.Errorf("middleware %s: unknown type %q", name, m.Type)
+		}
+		mf, err := factory(m.Config)
+		if err != nil {
+			return nil, fmt.Errorf("middleware %s: %v", name, err)
+		}
+		mfs[name] = mf
+	}
+	return mfs, nil
+}
+
+func lookupMiddlewares(mfs map[string]echo.MiddlewareFunc, names ...string) ([]echo.MiddlewareFunc, error) {
+	result := make([]echo.MiddlewareFunc, 0, len(names))
+	for _, name := range names {
+		mf, ok := mfs[name]
+		if !ok {
+			return nil, fmt.Errorf("middleware %s is not configured", name)
+		}
+		result = append(result, mf)
+	}
+	return result, nil
+}
+
+// duration accepts both "1m30s" style strings and plain nanoseconds.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case float64:
+		*d = duration(value)
+	case string:
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*d = duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration %s", b)
+	}
+	return nil
+}
+
+func corsMiddleware(config any) (echo.MiddlewareFunc, error) {
+	var cfg struct {
+		AllowOrigins     []string
+		AllowMethods     []string
+		AllowHeaders     []string
+		ExposeHeaders    []string
+		AllowCredentials bool
+		MaxAge           int
+	}
+	if err := DecodeMiddlewareConfig(config, &cfg); err != nil {
+		return nil, err
+	}
+	return ew.CORSWithConfig(ew.CORSConfig{
+		AllowOrigins:     cfg.AllowOrigins,
+		AllowMethods:     cfg.AllowMethods,
+		AllowHeaders:     cfg.AllowHeaders,
+		ExposeHeaders:    cfg.ExposeHeaders,
+		AllowCredentials: cfg.AllowCredentials,
+		MaxAge:           cfg.MaxAge,
+	}), nil
+}
+
+func gzipMiddleware(config any) (echo.MiddlewareFunc, error) {
+	var cfg struct {
+		Level int
+	}
+	if err := DecodeMiddlewareConfig(config, &cfg); err != nil {
+		return nil, err
+	}
+	return ew.GzipWithConfig(ew.GzipConfig{Level: cfg.Level}), nil
+}
+
+func rateLimitMiddleware(config any) (echo.MiddlewareFunc, error) {
+	var cfg struct {
+		Rate      float64
+		Burst     int
+		ExpiresIn duration
+	}
+	if err := DecodeMiddlewareConfig(config, &cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Rate <= 0 {
+		return nil, fmt.Errorf("rate must be positive")
+	}
+	store := ew.NewRateLimiterMemoryStoreWithConfig(ew.RateLimiterMemoryStoreConfig{
+		Rate:      rate.Limit(cfg.Rate),
+		Burst:     cfg.Burst,
+		ExpiresIn: time.Duration(cfg.ExpiresIn),
+	})
+	return ew.RateLimiter(store), nil
+}
+
+func bodyLimitMiddleware(config any) (echo.MiddlewareFunc, error) {
+	var cfg struct {
+		Limit string
+	}
+	if err := DecodeMiddlewareConfig(config, &cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Limit == "" {
+		return nil, fmt.Errorf("limit is required")
+	}
+	return ew.BodyLimit(cfg.Limit), nil
+}
+
+func timeoutMiddleware(config any) (echo.MiddlewareFunc, error) {
+	var cfg struct {
+		Timeout      duration
+		ErrorMessage string
+	}
+	if err := DecodeMiddlewareConfig(config, &cfg); err != nil {
+		return nil, err
+	}
+	return ew.TimeoutConfig{
+		Timeout:      time.Duration(cfg.Timeout),
+		ErrorMessage: cfg.ErrorMessage,
+	}.ToMiddleware()
+}
+
+func secureMiddleware(config any) (echo.MiddlewareFunc, error) {
+	cfg := ew.DefaultSecureConfig
+	if err := DecodeMiddlewareConfig(config, &cfg); err != nil {
+		return nil, err
+	}
+	return ew.SecureWithConfig(cfg), nil
+}
+
+func requestIdMiddleware(config any) (echo.MiddlewareFunc, error) {
+	var cfg struct {
+		TargetHeader string
+	}
+	if err := DecodeMiddlewareConfig(config, &cfg); err != nil {
+		return nil, err
+	}
+	return ew.RequestIDWithConfig(ew.RequestIDConfig{TargetHeader: cfg.TargetHeader}), nil
+}
+
+func recoverMiddleware(config any) (echo.MiddlewareFunc, error) {
+	cfg := ew.DefaultRecoverConfig
+	var raw struct {
+		StackSize         int
+		DisableStackAll   bool
+		DisablePrintStack bool
+	}
+	if err := DecodeMiddlewareConfig(config, &raw); err != nil {
+		return nil, err
+	}
+	if raw.StackSize > 0 {
+		cfg.StackSize = raw.StackSize
+	}
+	cfg.DisableStackAll = raw.DisableStackAll
+	cfg.DisablePrintStack = raw.DisablePrintStack
+	return ew.RecoverWithConfig(cfg), nil
+}
+
+func decompressMiddleware(any) (echo.MiddlewareFunc, error) {
+	return ew.Decompress(), nil
+}
+
+// configuredMiddlewares returns the sorted names of the configured middlewares
+// accepted by match, so they are attached in a stable order.
+func configuredMiddlewares(mc middlewareConfig, match func(m middlewareEntry) bool) []string {
+	names := make([]string, 0, len(mc.Middlewares))
+	for name, m := range mc.Middlewares {
+		if match(m) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,148 @@
+package echoserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// encodeMsgpack writes the MessagePack representation of the json encoding
+// of v.
+func encodeMsgpack(w io.Writer, v any) error {
+	g, err := toGeneric(v)
+	if err != nil {
+		return err
+	}
+	e := msgpack.NewEncoder(w)
+	e.SetSortMapKeys(true)
+	e.UseCompactInts(true)
+	return e.Encode(fromJSONNumbers(g))
+}
+
+// decodeMsgpack decodes a MessagePack document into v through its json
+// representation, so json tags apply. The body is read whole, bounded by
+// Http.MaxBodyBytes, and checked by checkMsgpack first, as the decoder
+// preallocates from declared lengths and does not bound nesting.
+func decodeMsgpack(r io.Reader, v any) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if err := checkMsgpack(b); err != nil {
+		return fmt.Errorf("msgpack: %v", err)
+	}
+	g, err := msgpack.NewDecoder(bytes.NewReader(b)).DecodeInterface()
+	if err != nil {
+		return fmt.Errorf("msgpack: %v", err)
+	}
+	return fromGeneric(g, v)
+}
+
+// checkMsgpack verifies that b holds a single well formed MessagePack value
+// nested at most maxDecodeDepth deep, whose declared lengths all fit in the
+// bytes left.
+func checkMsgpack(b []byte) error {
+	rest, err := skipMsgpack(b, maxDecodeDepth)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return fmt.Errorf("%d bytes of trailing data", len(rest))
+	}
+	return nil
+}
+
+// skipMsgpack returns what follows the value b starts with.
+func skipMsgpack(b []byte, depth int) ([]byte, error) {
+	if depth == 0 {
+		return nil, fmt.Errorf("nested deeper than %d levels", maxDecodeDepth)
+	}
+	if len(b) == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	c := b[0]
+	b = b[1:]
+	// size is the length of the payload, items the number of nested values.
+	var size, items uint64
+	var err error
+	switch {
+	case c <= 0x7f, c >= 0xe0, c == 0xc0, c == 0xc2, c == 0xc3:
+		return b, nil
+	case c&0xe0 == 0xa0:
+		size = uint64(c & 0x1f)
+	case c&0xf0 == 0x90:
+		items = uint64(c & 0x0f)
+	case c&0xf0 == 0x80:
+		items = 2 * uint64(c&0x0f)
+	default:
+		switch c {
+		case 0xcc, 0xd0:
+			size = 1
+		case 0xcd, 0xd1, 0xd4:
+			size = 2
+		case 0xd5:
+			size = 3
+		case 0xca, 0xce, 0xd2:
+			size = 4
+		case 0xd6:
+			size = 5
+		case 0xcb, 0xcf, 0xd3:
+			size = 8
+		case 0xd7:
+			size = 9
+		case 0xd8:
+			size = 17
+		case 0xc4, 0xd9:
+			size, b, err = msgpackLength(b, 1)
+		case 0xc5, 0xda:
+			size, b, err = msgpackLength(b, 2)
+		case 0xc6, 0xdb:
+			size, b, err = msgpackLength(b, 4)
+		case 0xc7, 0xc8, 0xc9:
+			// ext formats carry a type byte after their length
+			size, b, err = msgpackLength(b, 1<<(c-0xc7))
+			size++
+		case 0xdc, 0xdd:
+			items, b, err = msgpackLength(b, 2<<(c-0xdc))
+		case 0xde, 0xdf:
+			items, b, err = msgpackLength(b, 2<<(c-0xde))
+			items *= 2
+		default:
+			return nil, fmt.Errorf("invalid format 0x%x", c)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if size > uint64(len(b)) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b = b[size:]
+	// every nested value takes at least a byte
+	if items > uint64(len(b)) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	for ; items > 0; items-- {
+		if b, err = skipMsgpack(b, depth-1); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// msgpackLength reads a big endian length of n bytes.
+func msgpackLength(b []byte, n int) (uint64, []byte, error) {
+	if len(b) < n {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	switch n {
+	case 1:
+		return uint64(b[0]), b[1:], nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), b[2:], nil
+	}
+	return uint64(binary.BigEndian.Uint32(b)), b[4:], nil
+}
@@ -0,0 +1,355 @@
+package echoserver
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/aliworkshop/errors"
+	"github.com/aliworkshop/gateway/v2"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	paginationContextKey = "_echoserver.pagination"
+	minCursorSecretLen   = 16
+)
+
+type PaginationConfig struct {
+	// CursorSecret signs the cursors handed to clients and must be at least
+	// 16 bytes long. A random secret is used when it is empty, so cursors do
+	// not survive restarts and are not shared between instances; the server
+	// logs a warning at startup in that case.
+	CursorSecret string
+	PageSize     PageSizeLimits
+}
+
+// PageSizeLimits bounds the $page_size and $limit query parameters. A zero
+// Default keeps the default of the paginator and a Max of zero or less leaves
+// the page size unbounded. The server config defaults Max to 100.
+type PageSizeLimits struct {
+	Default int
+	Max     int
+	// Reject answers out of range page sizes with a validation error instead
+	// of clamping them into range.
+	Reject bool
+}
+
+// pageSizeGuard applies the page size limits of a router group to the
+// paginator of each request. Groups without limits of their own inherit the
+// limits of their parent, and eventually those of the server config.
+type pageSizeGuard struct {
+	live   *liveConfig
+	limits *groupSetting[PageSizeLimits]
+}
+
+func newPageSizeGuard(live *liveConfig, parent *pageSizeGuard) *pageSizeGuard {
+	g := &pageSizeGuard{live: live}
+	if parent != nil {
+		g.limits = newGroupSetting(parent.limits)
+	} else {
+		g.limits = newGroupSetting[PageSizeLimits](nil)
+	}
+	return g
+}
+
+func (g *pageSizeGuard) current() PageSizeLimits {
+	if limits, ok := g.limits.get(); ok {
+		return limits
+	}
+	return g.live.Load().Pagination.PageSize
+}
+
+func (g *pageSizeGuard) Handle(req gateway.HttpRequester) (any, errors.ErrorModel) {
+	limits := g.current()
+	if limits.Default <= 0 && limits.Max <= 0 {
+		return nil, nil
+	}
+	p := req.Paginator()
+	param := "$page_size"
+	if _, ok := p.(*CursorPaginator); ok {
+		param = "$limit"
+	}
+	size, err := strconv.Atoi(req.GetQuery(param))
+	switch {
+	case err != nil:
+		if limits.Default > 0 {
+			p.SetPageSize(limits.Default)
+		}
+	case size < 1:
+		if limits.Reject {
+			return nil, pageSizeError(param, "min", 1)
+		}
+		p.SetPageSize(max(limits.Default, 1))
+	case limits.Max > 0 && size > limits.Max && limits.Reject:
+		return nil, pageSizeError(param, "max", limits.Max)
+	}
+	if limits.Max > 0 && p.GetPageSize() > limits.Max {
+		p.SetPageSize(limits.Max)
+	}
+	return nil, nil
+}
+
+func pageSizeError(param, tag string, bound int) errors.ErrorModel {
+	err := fmt.Errorf("%s must be at least %d", param, bound)
+	if tag == "max" {
+		err = fmt.Errorf("%s must be at most %d", param, bound)
+	}
+	return errors.Validation(err).WithProperty("error", err.Error()).WithProperty("fields", []FieldError{{
+		Field:   param,
+		Tag:     tag,
+		Param:   strconv.Itoa(bound),
+		Message: err.Error(),
+	}})
+}
+
+// CursorResponse is the envelope of cursor paginated responses.
+type CursorResponse struct {
+	Limit      int    `json:"limit"`
+	Items      any    `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	PrevCursor string `json:"prev_cursor,omitempty"`
+}
+
+// CursorPaginator is the paginator of requests carrying $cursor or $limit.
+// Handlers decode the position to continue from with Cursor and hand out the
+// positions of the neighbouring pages with SetNextCursor and SetPrevCursor.
+type CursorPaginator struct {
+	gateway.IPaginator
+	secret []byte
+	cursor string
+	next   string
+	prev   string
+}
+
+func NewCursorPaginator(secret []byte, cursor string, limit int) *CursorPaginator {
+	p := &CursorPaginator{
+		IPaginator: gateway.NewPaginator(),
+		secret:     secret,
+		cursor:     cursor,
+	}
+	if limit > 0 {
+		p.SetPageSize(limit)
+	}
+	return p
+}
+
+func (p *CursorPaginator) Limit() int {
+	return p.GetPageSize()
+}
+
+func (p *CursorPaginator) HasCursor() bool {
+	return p.cursor != ""
+}
+
+// Cursor decodes the cursor of the request into v. It leaves v untouched
+// when the request has no cursor.
+func (p *CursorPaginator) Cursor(v any) errors.ErrorModel {
+	if p.cursor == "" {
+		return nil
+	}
+	if err := DecodeCursor(p.secret, p.cursor, v); err != nil {
+		return errors.Validation(err).WithProperty("error", err.Error())
+	}
+	return nil
+}
+
+// SetNextCursor encodes v as the cursor of the next page. A nil v means
+// there is no next page.
+func (p *CursorPaginator) SetNextCursor(v any) errors.ErrorModel {
+	cursor, err := p.encode(v)
+	if err != nil {
+		return err
+	}
+	p.next = cursor
+	return nil
+}
+
+// SetPrevCursor encodes v as the cursor of the previous page. A nil v means
+// there is no previous page.
+func (p *CursorPaginator) SetPrevCursor(v any) errors.ErrorModel {
+	cursor, err := p.encode(v)
+	if err != nil {
+		return err
+	}
+	p.prev = cursor
+	return nil
+}
+
+func (p *CursorPaginator) NextCursor() string {
+	return p.next
+}
+
+func (p *CursorPaginator) PrevCursor() string {
+	return p.prev
+}
+
+func (p *CursorPaginator) encode(v any) (string, errors.ErrorModel) {
+	if v == nil {
+		return "", nil
+	}
+	cursor, err := EncodeCursor(p.secret, v)
+	if err != nil {
+		return "", errors.HandleError(err)
+	}
+	return cursor, nil
+}
+
+// EncodeCursor returns the json encoding of v signed with secret as an opaque
+// url safe string.
+func EncodeCursor(secret []byte, v any) (string, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(signCursor(secret, payload)), nil
+}
+
+// DecodeCursor verifies a cursor made by EncodeCursor and decodes it into v.
+func DecodeCursor(secret []byte, cursor string, v any) error {
+	enc := base64.RawURLEncoding
+	encodedPayload, encodedSig, ok := strings.Cut(cursor, ".")
+	if !ok {
+		return fmt.Errorf("invalid cursor")
+	}
+	payload, err := enc.DecodeString(encodedPayload)
+	if err != nil {
+		return fmt.Errorf("invalid cursor")
+	}
+	sig, err := enc.DecodeString(encodedSig)
+	if err != nil || !hmac.Equal(sig, signCursor(secret, payload)) {
+		return fmt.Errorf("invalid cursor")
+	}
+	return json.Unmarshal(payload, v)
+}
+
+func signCursor(secret, payload []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// pagination provides the live pagination settings to requests.
+type pagination struct {
+	live           *liveConfig
+	fallbackSecret []byte
+}
+
+func newPagination(live *liveConfig) *pagination {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return &pagination{live: live, fallbackSecret: secret}
+}
+
+func (p *pagination) cursorSecret() []byte {
+	if secret := p.live.Load().Pagination.CursorSecret; secret != "" {
+		return []byte(secret)
+	}
+	return p.fallbackSecret
+}
+
+func injectPagination(p *pagination) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set(paginationContextKey, p)
+			return next(c)
+		}
+	}
+}
+
+// defaultPagination serves requests not created by a server.
+var defaultPagination = newPagination(newLiveConfig(config{}))
+
+func getPagination(c echo.Context) *pagination {
+	if p, ok := c.Get(paginationContextKey).(*pagination); ok {
+		return p
+	}
+	return defaultPagination
+}
+
+// linkURI returns the request uri with the given query parameters replaced.
+func linkURI(c echo.Context, params url.Values) string {
+	u := *c.Request().URL
+	query := u.Query()
+	for k, v := range params {
+		query[k] = v
+	}
+	u.RawQuery = query.Encode()
+	return u.RequestURI()
+}
+
+// setLinkHeader sets an RFC 8288 Link header with the given relations.
+func setLinkHeader(c echo.Context, links map[string]string) {
+	var values []string
+	for _, rel := range []string{"first", "prev", "next", "last"} {
+		if uri, ok := links[rel]; ok {
+			values = append(values, fmt.Sprintf(`<%s>; rel="%s"`, uri, rel))
+		}
+	}
+	if len(values) > 0 {
+		c.Response().Header().Set("Link", strings.Join(values, ", "))
+	}
+}
+
+// setPaginationHeaders sets the Link header of the neighbouring pages of a
+// response, and the X-Total-Count header of page based GET list responses.
+// It returns the links for the envelope.
+func setPaginationHeaders(c echo.Context, p gateway.IPaginator, result any) map[string]string {
+	links := make(map[string]string)
+	if cp, ok := p.(*CursorPaginator); ok {
+		if cp.NextCursor() != "" {
+			links["next"] = linkURI(c, url.Values{"$cursor": {cp.NextCursor()}})
+		}
+		if cp.PrevCursor() != "" {
+			links["prev"] = linkURI(c, url.Values{"$cursor": {cp.PrevCursor()}})
+		}
+		setLinkHeader(c, links)
+		return links
+	}
+
+	switch c.Request().Method {
+	case http.MethodGet, http.MethodHead:
+	default:
+		return links
+	}
+	if !isList(result) {
+		return links
+	}
+	page, size, total := p.GetPage(), p.GetPageSize(), p.Total()
+	if page < 1 || size < 1 {
+		return links
+	}
+	pageURI := func(page int) string {
+		return linkURI(c, url.Values{"$page": {strconv.Itoa(page)}, "$page_size": {strconv.Itoa(size)}})
+	}
+	links["first"] = pageURI(1)
+	if page > 1 {
+		links["prev"] = pageURI(page - 1)
+	}
+	if total > 0 {
+		c.Response().Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+		last := int((total + int64(size) - 1) / int64(size))
+		if page < last {
+			links["next"] = pageURI(page + 1)
+		}
+		links["last"] = pageURI(last)
+	}
+	setLinkHeader(c, links)
+	return links
+}
+
+func isList(result any) bool {
+	kind := reflect.ValueOf(result).Kind()
+	return kind == reflect.Slice || kind == reflect.Array
+}
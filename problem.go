@@ -0,0 +1,82 @@
+package echoserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/aliworkshop/errors"
+	"github.com/labstack/echo/v4"
+)
+
+const MIMEApplicationProblemJSON = "application/problem+json"
+
+// ProblemDetails is an RFC 9457 problem details object. Extensions are
+// serialized as members next to the standard ones.
+type ProblemDetails struct {
+	Type       string         `json:"type"`
+	Title      string         `json:"title"`
+	Status     int            `json:"status"`
+	Detail     string         `json:"detail,omitempty"`
+	Instance   string         `json:"instance,omitempty"`
+	Extensions map[string]any `json:"-"`
+}
+
+func (p ProblemDetails) MarshalJSON() ([]byte, error) {
+	m := make(map[string]any, len(p.Extensions)+5)
+	for k, v := range p.Extensions {
+		m[k] = v
+	}
+	m["type"] = p.Type
+	m["title"] = p.Title
+	m["status"] = p.Status
+	if p.Detail != "" {
+		m["detail"] = p.Detail
+	}
+	if p.Instance != "" {
+		m["instance"] = p.Instance
+	}
+	return json.Marshal(m)
+}
+
+// newProblemDetails describes err, whose message is expected to be localized
+// already. Error types are resolved against typeBase when it is set.
+func newProblemDetails(err errors.ErrorModel, code int, requestUUID, typeBase string) ProblemDetails {
+	p := ProblemDetails{
+		Type:       "about:blank",
+		Title:      http.StatusText(code),
+		Status:     code,
+		Detail:     err.Message(),
+		Extensions: make(map[string]any, len(err.Properties())+2),
+	}
+	if typeBase != "" && err.Id() != "" {
+		p.Type = strings.TrimSuffix(typeBase, "/") + "/" + err.Id()
+	}
+	if requestUUID != "" {
+		p.Instance = "urn:uuid:" + requestUUID
+	}
+	for k, v := range err.Properties() {
+		p.Extensions[k] = v
+	}
+	p.Extensions["id"] = err.Id()
+	p.Extensions["message"] = err.Message()
+	return p
+}
+
+// wantsProblem reports whether the client asked for problem details.
+func wantsProblem(ctx echo.Context) bool {
+	for _, a := range parseAccept(ctx.Request().Header.Get(echo.HeaderAccept)) {
+		if a.mediaType == MIMEApplicationProblemJSON && a.q > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func respondProblem(ctx echo.Context, p ProblemDetails) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return ctx.Blob(p.Status, MIMEApplicationProblemJSON, b)
+}
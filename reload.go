@@ -0,0 +1,293 @@
+package echoserver
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aliworkshop/configer"
+	"github.com/aliworkshop/logger"
+	"github.com/fsnotify/fsnotify"
+	"github.com/labstack/echo/v4"
+	ew "github.com/labstack/echo/v4/middleware"
+)
+
+// swappableMiddleware delegates to a middleware that can be replaced while the
+// server is serving.
+type swappableMiddleware struct {
+	current atomic.Value
+}
+
+func newSwappableMiddleware(mf echo.MiddlewareFunc) *swappableMiddleware {
+	s := &swappableMiddleware{}
+	s.Swap(mf)
+	return s
+}
+
+func (s *swappableMiddleware) Swap(mf echo.MiddlewareFunc) {
+	s.current.Store(mf)
+}
+
+func (s *swappableMiddleware) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return s.current.Load().(echo.MiddlewareFunc)(next)(c)
+	}
+}
+
+func passThrough(next echo.HandlerFunc) echo.HandlerFunc {
+	return next
+}
+
+// liveConfig holds the config the server is currently serving with.
+type liveConfig struct {
+	current atomic.Pointer[config]
+}
+
+func newLiveConfig(c config) *liveConfig {
+	l := &liveConfig{}
+	l.current.Store(&c)
+	return l
+}
+
+func (l *liveConfig) Load() *config {
+	return l.current.Load()
+}
+
+// hotReloader swaps the hot reloadable parts of a running server.
+type hotReloader struct {
+	mtx         sync.Mutex
+	live        *liveConfig
+	logger      logger.Logger
+	cors        *swappableMiddleware
+	accessLog   *swappableMiddleware
+	middlewares map[string]*swappableMiddleware
+	// serving is the http.Server the server runs on, set once it starts.
+	serving atomic.Pointer[http.Server]
+}
+
+// restartKeys are the config keys that are only applied on start.
+// ReadHeaderTimeout, IdleTimeout and MaxHeaderBytes are read by http.Server
+// from its own fields on every connection without synchronization, so they
+// cannot be changed while it serves. ConnectionTimeout only provides their
+// defaults.
+var restartKeys = map[string]struct{}{
+	"Development":       {},
+	"ConnectionTimeout": {},
+	"ReadHeaderTimeout": {},
+	"IdleTimeout":       {},
+	"MaxHeaderBytes":    {},
+	"TLS":               {},
+	"ReloadInterval":    {},
+	"Health":            {},
+	"Metrics":           {},
+	"Admin":             {},
+}
+
+func corsMiddlewareFromConfig(c Http) echo.MiddlewareFunc {
+	return ew.CORSWithConfig(ew.CORSConfig{
+		AllowOrigins: c.Cors.AllowOrigins,
+		AllowMethods: c.Cors.AllowMethods,
+		AllowHeaders: c.Cors.AllowHeaders,
+	})
+}
+
+func (hr *hotReloader) apply(cfg config) error {
+	if err := cfg.validate(); err != nil {
+		hr.logf("config reload rejected: %v", err)
+		return err
+	}
+
+	hr.mtx.Lock()
+	defer hr.mtx.Unlock()
+	old := hr.live.Load()
+	// Only the middlewares whose config changed are rebuilt, so the others
+	// keep their state, e.g. the counters of rate limiters.
+	mfs, err := buildMiddlewares(changedMiddlewares(old.middlewareConfig, cfg.middlewareConfig))
+	if err != nil {
+		hr.logf("config reload rejected: %v", err)
+		return err
+	}
+	changed := changedKeys(*old, cfg)
+	if len(changed) == 0 {
+		return nil
+	}
+
+	hr.cors.Swap(corsMiddlewareFromConfig(cfg.Http))
+	if hr.accessLog != nil {
+		hr.accessLog.Swap(NewLoggerHandler(hr.logger, cfg.Http))
+	}
+	for name, s := range hr.middlewares {
+		if mf, ok := mfs[name]; ok {
+			s.Swap(mf)
+		} else if _, ok := cfg.Middlewares[name]; !ok {
+			s.Swap(passThrough)
+		}
+	}
+	hr.live.current.Store(&cfg)
+	if s := hr.serving.Load(); s != nil {
+		s.SetKeepAlivesEnabled(!cfg.DisableKeepAlives)
+	}
+
+	var restart []string
+	for _, key := range changed {
+		if _, ok := restartKeys[key]; ok {
+			restart = append(restart, key)
+		}
+	}
+	for name, m := range cfg.Middlewares {
+		prev, existed := old.Middlewares[name]
+		if !existed || prev.Global != m.Global || !reflect.DeepEqual(prev.Groups, m.Groups) {
+			restart = append(restart, "Middlewares."+name)
+		}
+	}
+	hr.logf("config reloaded, changed keys: %v", changed)
+	if len(restart) > 0 {
+		sort.Strings(restart)
+		hr.logf("config keys %v only take effect after a restart", restart)
+	}
+	return nil
+}
+
+// changedMiddlewares returns the entries of next that are new or whose type
+// or config differ from prev.
+func changedMiddlewares(prev, next middlewareConfig) middlewareConfig {
+	changed := middlewareConfig{Middlewares: make(map[string]middlewareEntry)}
+	for name, m := range next.Middlewares {
+		if p, ok := prev.Middlewares[name]; ok && p.Type == m.Type && reflect.DeepEqual(p.Config, m.Config) {
+			continue
+		}
+		changed.Middlewares[name] = m
+	}
+	return changed
+}
+
+// applyTimeouts sets the ReadTimeout and WriteTimeout of the live config as
+// deadlines of each request's connection once a reload changed them from the
+// values the http.Server started with.
+func (hr *hotReloader) applyTimeouts(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		s := hr.serving.Load()
+		if s == nil {
+			return next(c)
+		}
+		cfg := hr.live.Load()
+		if cfg.ReadTimeout == s.ReadTimeout && cfg.WriteTimeout == s.WriteTimeout {
+			return next(c)
+		}
+		rc := http.NewResponseController(c.Response().Writer)
+		now := time.Now()
+		if cfg.ReadTimeout != s.ReadTimeout {
+			_ = rc.SetReadDeadline(deadline(now, cfg.ReadTimeout))
+		}
+		if cfg.WriteTimeout != s.WriteTimeout {
+			_ = rc.SetWriteDeadline(deadline(now, cfg.WriteTimeout))
+			// http.Server only resets the write deadline between requests
+			// when it has a WriteTimeout of its own.
+			defer rc.SetWriteDeadline(time.Time{})
+		}
+		return next(c)
+	}
+}
+
+func deadline(now time.Time, timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return now.Add(timeout)
+}
+
+func (hr *hotReloader) logf(format string, args ...any) {
+	if hr.logger == nil {
+		log.Printf(format, args...)
+		return
+	}
+	hr.logger.WithId("echoServer").InfoF(format, args...)
+}
+
+// changedKeys lists the names of the Http fields and middlewares that differ
+// between two configs.
+func changedKeys(old, new config) []string {
+	var keys []string
+	ov, nv := reflect.ValueOf(old.Http), reflect.ValueOf(new.Http)
+	for i := 0; i < ov.NumField(); i++ {
+		if !reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
+			keys = append(keys, ov.Type().Field(i).Name)
+		}
+	}
+	for name, m := range new.Middlewares {
+		if prev, ok := old.Middlewares[name]; !ok || !reflect.DeepEqual(prev, m) {
+			keys = append(keys, "Middlewares."+name)
+		}
+	}
+	for name := range old.Middlewares {
+		if _, ok := new.Middlewares[name]; !ok {
+			keys = append(keys, "Middlewares."+name)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (es *echoServer) Reload() error {
+	if es.configRegistry == nil || es.reloader == nil {
+		return fmt.Errorf("server has no config registry to reload from")
+	}
+	var cfg config
+	if err := es.configRegistry.Unmarshal(&cfg); err != nil {
+		es.reloader.logf("config reload rejected: %v", err)
+		return err
+	}
+	cfg.Initialize()
+	return es.reloader.apply(cfg)
+}
+
+// ConfigWatcher is implemented by config registries that report changes of
+// their source, such as a watched file. The server reloads on every change.
+type ConfigWatcher interface {
+	OnChange(fn func())
+}
+
+// viperWatcher matches registries backed by viper.
+type viperWatcher interface {
+	WatchConfig()
+	OnConfigChange(run func(in fsnotify.Event))
+}
+
+// subscribeConfig reloads the config whenever the registry reports a change
+// until stop is closed. Registries that cannot report changes are left to
+// ReloadInterval and explicit Reload calls.
+func (es *echoServer) subscribeConfig(registry configer.Registry, stop <-chan struct{}) {
+	reload := func() {
+		select {
+		case <-stop:
+		default:
+			_ = es.Reload()
+		}
+	}
+	switch w := registry.(type) {
+	case ConfigWatcher:
+		w.OnChange(reload)
+	case viperWatcher:
+		w.OnConfigChange(func(fsnotify.Event) { reload() })
+		w.WatchConfig()
+	}
+}
+
+// watchConfig reloads the config every interval until stop is closed.
+func (es *echoServer) watchConfig(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_ = es.Reload()
+		case <-stop:
+			return
+		}
+	}
+}
@@ -2,13 +2,19 @@ package echoserver
 
 import (
 	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
 	"io"
 	"io/fs"
 	"log"
+	"mime"
 	"mime/multipart"
 	"net/http"
+	"reflect"
 	"strconv"
 	"sync"
+	"time"
 
 	ad "github.com/aliworkshop/authorizer/port"
 	"github.com/aliworkshop/dfilter"
@@ -19,6 +25,29 @@ import (
 	"github.com/nicksnyder/go-i18n/v2/i18n"
 )
 
+// Requester extends gateway.HttpRequester with the echo specific features of
+// the package.
+type Requester interface {
+	gateway.HttpRequester
+	// ClientCertificate returns the verified client certificate of a mutual
+	// TLS connection, or nil.
+	ClientCertificate() *x509.Certificate
+	// ClientSubject returns the subject of the verified client certificate.
+	ClientSubject() string
+	// BindPatch applies the JSON Merge Patch or JSON Patch in the request
+	// body, chosen by its Content-Type, to target and validates the result.
+	BindPatch(target any) errors.ErrorModel
+	// SetETag sets the entity tag of the response. It replaces the weak
+	// entity tag computed from the body of successful READ responses.
+	SetETag(etag string, weak bool)
+	// SetLastModified sets the Last-Modified time of the response.
+	SetLastModified(t time.Time)
+	// CheckPreconditions evaluates If-Match, or otherwise If-Unmodified-Since,
+	// against the current entity tag and modification time of the resource.
+	// A failed precondition returns an error answered with 412.
+	CheckPreconditions(etag string, lastModified time.Time) errors.ErrorModel
+}
+
 type request struct {
 	uid               string
 	requestUUID       string
@@ -91,6 +120,22 @@ func (r *request) GetClientIp() string {
 	return r.context.RealIP()
 }
 
+func (r *request) ClientCertificate() *x509.Certificate {
+	state := r.context.Request().TLS
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+func (r *request) ClientSubject() string {
+	cert := r.ClientCertificate()
+	if cert == nil {
+		return ""
+	}
+	return cert.Subject.String()
+}
+
 func (r *request) GetMethod() string {
 	return r.context.Request().Method
 }
@@ -124,10 +169,66 @@ func (r *request) GetBody() any {
 }
 
 func (r *request) BindRequest(body gateway.Validatable) errors.ErrorModel {
-	if err := r.context.Bind(body); err != nil {
+	if err := bind(r.context, body); err != nil {
+		return bindError(err)
+	}
+	return r.validate(body)
+}
+
+// TagValidatable is implemented by bodies whose validate tags BindRequest and
+// BindPatch check before calling Validate, so failed rules are reported field
+// by field. Other bodies are only checked by their Validate method.
+type TagValidatable interface {
+	gateway.Validatable
+	ValidateTags() bool
+}
+
+func (r *request) validate(body gateway.Validatable) errors.ErrorModel {
+	v := getValidator(r.context)
+	if tv, ok := body.(TagValidatable); ok && tv.ValidateTags() {
+		if err := v.Struct(body); err != nil {
+			return ValidationError(r, err, body)
+		}
+	}
+	return body.Validate(v, r.language)
+}
+
+func (r *request) BindPatch(target any) errors.ErrorModel {
+	limitBody(r.context)
+	patch, err := io.ReadAll(r.context.Request().Body)
+	if err != nil {
+		return bindError(err)
+	}
+	doc, err := json.Marshal(target)
+	if err != nil {
+		return errors.HandleError(err)
+	}
+	contentType, _, _ := mime.ParseMediaType(r.GetHeader(echo.HeaderContentType))
+	var patched []byte
+	switch contentType {
+	case MIMEMergePatch, echo.MIMEApplicationJSON:
+		patched, err = ApplyMergePatch(doc, patch)
+	case MIMEJSONPatch:
+		patched, err = ApplyJSONPatch(doc, patch)
+	default:
+		return bindError(echo.ErrUnsupportedMediaType)
+	}
+	if err != nil {
 		return errors.Validation(err).WithProperty("error", err.Error())
 	}
-	return body.Validate(getValidator(r.context), r.language)
+
+	v := reflect.ValueOf(target)
+	if v.Kind() != reflect.Pointer || v.IsNil() {
+		return errors.HandleError(fmt.Errorf("patch target must be a non-nil pointer"))
+	}
+	v.Elem().Set(reflect.Zero(v.Elem().Type()))
+	if err := json.Unmarshal(patched, target); err != nil {
+		return errors.Validation(err).WithProperty("error", err.Error())
+	}
+	if body, ok := target.(gateway.Validatable); ok {
+		return r.validate(body)
+	}
+	return nil
 }
 
 func (r *request) SetLanguage(language gateway.Language) {
@@ -244,6 +345,11 @@ func (r *request) Paginator() gateway.IPaginator {
 	if r.paginator != nil {
 		return r.paginator
 	}
+	if cursor, limit := r.GetQuery("$cursor"), r.GetQuery("$limit"); cursor != "" || limit != "" {
+		size, _ := strconv.Atoi(limit)
+		r.paginator = NewCursorPaginator(getPagination(r.context).cursorSecret(), cursor, size)
+		return r.paginator
+	}
 	p := gateway.NewPaginator()
 	if page, err := strconv.Atoi(r.GetQuery("$page")); err == nil {
 		p.SetPage(page)
@@ -9,22 +9,60 @@ import (
 	"github.com/nicksnyder/go-i18n/v2/i18n"
 )
 
-func NewResponder(languageBundle *i18n.Bundle) gateway.Responder {
-	return &echoResponder{languageBundle: languageBundle}
+// ResponderOption customizes the responders of the package.
+type ResponderOption func(o *responderOptions)
+
+type responderOptions struct {
+	problemDetails bool
+	problemType    string
+}
+
+// WithProblemDetails renders errors as RFC 9457 application/problem+json.
+// The type member of a problem is typeBase joined with the error id, or
+// about:blank when typeBase is empty.
+func WithProblemDetails(typeBase string) ResponderOption {
+	return func(o *responderOptions) {
+		o.problemDetails = true
+		o.problemType = typeBase
+	}
 }
 
-func NewEmptyResponder(languageBundle *i18n.Bundle) gateway.Responder {
-	return &emptyResponder{languageBundle: languageBundle}
+func NewResponder(languageBundle *i18n.Bundle, opts ...ResponderOption) gateway.Responder {
+	er := &echoResponder{languageBundle: languageBundle}
+	for _, opt := range opts {
+		opt(&er.responderOptions)
+	}
+	return er
+}
+
+func NewEmptyResponder(languageBundle *i18n.Bundle, opts ...ResponderOption) gateway.Responder {
+	er := &emptyResponder{languageBundle: languageBundle}
+	for _, opt := range opts {
+		opt(&er.responderOptions)
+	}
+	return er
 }
 
 type echoResponder struct {
+	responderOptions
 	languageBundle *i18n.Bundle
 }
 
 type emptyResponder struct {
+	responderOptions
 	languageBundle *i18n.Bundle
 }
 
+func (o *responderOptions) respondError(req gateway.HttpRequester, es ErrorStatus, err errors.ErrorModel) {
+	ctx := req.GetHttpContext().(echo.Context)
+	setErrorHeaders(ctx, es, err)
+	if o.problemDetails || wantsProblem(ctx) {
+		respondProblem(ctx, newProblemDetails(err, es.Code, req.RequestUUID(), o.problemType))
+		return
+	}
+	respondNegotiatedError(ctx, es.Code, err)
+}
+
 func (er *echoResponder) LanguageBundle() *i18n.Bundle {
 	return er.languageBundle
 }
@@ -44,7 +82,7 @@ func (er *echoResponder) Respond(req gateway.HttpRequester, status gateway.Statu
 			status = gateway.StatusCreated
 		case http.MethodGet:
 			status = gateway.StatusOK
-		case http.MethodDelete:
+		case http.MethodDelete, http.MethodPatch:
 			if result == nil {
 				status = gateway.StatusNoContent
 				break
@@ -68,24 +106,25 @@ func (er *echoResponder) Respond(req gateway.HttpRequester, status gateway.Statu
 	case gateway.StatusTemporaryRedirect:
 		ctx.Redirect(http.StatusTemporaryRedirect, result.(string))
 		return
-	case gateway.StatusNoContent:
-		ctx.NoContent(http.StatusNoContent)
+	}
+
+	code := getStatusCode(status)
+	if code == http.StatusNoContent || code == http.StatusNotModified {
+		ctx.NoContent(code)
 		return
 	}
 
+	result = projectFields(req, result)
 	p := req.Paginator()
-	response := gateway.Response{
-		Page:    int(p.GetPage()),
-		PerPage: int(p.GetPageSize()),
-		Items:   result,
-		Total:   p.Total(),
-	}
-	ctx.JSON(getStatusCode(status), response)
+	links := setPaginationHeaders(ctx, p, result)
+	body, stable := wrapResult(req, p, result, links)
+	respondConditional(ctx, req, code, body, stable)
 }
 
 func (er *echoResponder) RespondError(req gateway.HttpRequester, err errors.ErrorModel) {
 	ctx := req.GetHttpContext().(echo.Context)
 	ctx.Response().Header().Set("X-Request-Uuid", req.RequestUUID())
+	es := getErrorStatus(err)
 	if er.languageBundle != nil {
 		errId := err.Id()
 		if errId != "" && (err.IsMsgDefault() || !err.IsIdDefault() || len(err.Properties()) > 0) {
@@ -98,7 +137,7 @@ func (er *echoResponder) RespondError(req gateway.HttpRequester, err errors.Erro
 			}))
 		}
 	}
-	ctx.JSON(getStatusCodeByError(err), err)
+	er.respondError(req, es, err)
 	req.SetIsResponded(true)
 }
 
@@ -109,13 +148,13 @@ func (er *emptyResponder) LanguageBundle() *i18n.Bundle {
 func (er *emptyResponder) Respond(req gateway.HttpRequester, status gateway.Status, result any) {
 	ctx := req.GetHttpContext().(echo.Context)
 	ctx.Response().Header().Set("X-Request-Uuid", req.RequestUUID())
-	ctx.JSON(getStatusCode(status), result)
+	respondNegotiated(ctx, getStatusCode(status), result)
 	req.SetIsResponded(true)
 }
 
 func (er *emptyResponder) RespondError(req gateway.HttpRequester, err errors.ErrorModel) {
 	ctx := req.GetHttpContext().(echo.Context)
 	ctx.Response().Header().Set("X-Request-Uuid", req.RequestUUID())
-	ctx.JSON(getStatusCodeByError(err), err)
+	er.respondError(req, getErrorStatus(err), err)
 	req.SetIsResponded(true)
 }
@@ -8,7 +8,7 @@ import (
 )
 
 type router struct {
-	config config
+	live *liveConfig
 }
 
 func (rh *router) getHandler(controller gateway.Controller, handler gateway.Handler, shouldRespond bool) echo.HandlerFunc {
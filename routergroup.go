@@ -1,52 +1,133 @@
 package echoserver
 
 import (
+	"fmt"
 	"net/http"
 	"path/filepath"
+	"sync/atomic"
 
 	"github.com/aliworkshop/gateway/v2"
 	"github.com/labstack/echo/v4"
 	ew "github.com/labstack/echo/v4/middleware"
 )
 
+// RouterGroup extends gateway.RouterGroupModel with the echo specific
+// features of the package.
+type RouterGroup interface {
+	gateway.RouterGroupModel
+	// UseMiddleware attaches middlewares configured under the given names to
+	// every route of the group.
+	UseMiddleware(names ...string) error
+	// CSRF protects every route of the group with the csrf session type
+	// configured under Http.CSRF.SessionTypes.
+	CSRF(sessionType string) error
+	PATCH(path string, handlers ...gateway.Handler)
+	HEAD(path string, handlers ...gateway.Handler)
+	OPTIONS(path string, handlers ...gateway.Handler)
+	// Handle registers handlers for an arbitrary http method.
+	Handle(method, path string, handlers ...gateway.Handler)
+	// PageSize overrides Http.Pagination.PageSize for the routes of the
+	// group and of its sub groups.
+	PageSize(limits PageSizeLimits)
+	// Envelope overrides Http.Envelope for the routes of the group and of
+	// its sub groups.
+	Envelope(name string) error
+	// Cache caches the responses of the READ routes of the group registered
+	// after the call.
+	Cache(cfg CacheConfig) error
+}
+
 type routerGroup struct {
 	router
 	engine      *echo.Echo
 	routerGroup *echo.Group
 	c           gateway.Controller
-
-	mConfig middlewareConfig
+	prefix      string
+	pageSize    *pageSizeGuard
+	envelope    *envelopeSelector
+	middlewares map[string]echo.MiddlewareFunc
 }
 
-func newRouterGroup(e *echo.Echo, c gateway.Controller, config config, path string) *routerGroup {
-	return &routerGroup{
-		router:      router{config: config},
+func newRouterGroup(e *echo.Echo, c gateway.Controller, live *liveConfig, middlewares map[string]echo.MiddlewareFunc, path string) *routerGroup {
+	r := &routerGroup{
+		router:      router{live: live},
 		engine:      e,
 		c:           c,
 		routerGroup: e.Group(path),
+		prefix:      path,
+		pageSize:    newPageSizeGuard(live, nil),
+		envelope:    newEnvelopeSelector(live, nil),
+		middlewares: middlewares,
+	}
+	r.useConfiguredMiddlewares()
+	return r
+}
+
+// useConfiguredMiddlewares attaches the middlewares whose Groups include the
+// path of the group.
+func (r *routerGroup) useConfiguredMiddlewares() {
+	names := configuredMiddlewares(r.live.Load().middlewareConfig, func(m middlewareEntry) bool {
+		for _, g := range m.Groups {
+			if g == r.prefix {
+				return true
+			}
+		}
+		return false
+	})
+	if err := r.UseMiddleware(names...); err != nil {
+		panic(err)
 	}
 }
 
+// route matches the handlers of a route, applying the page size limits and
+// the envelope of the group first.
+func (r *routerGroup) route(handlers ...gateway.Handler) (echo.HandlerFunc, []echo.MiddlewareFunc) {
+	if len(handlers) == 0 {
+		return r.match(r.c, handlers...)
+	}
+	return r.match(r.c, append([]gateway.Handler{r.pageSize, r.envelope}, handlers...)...)
+}
+
 func (r *routerGroup) READ(path string, handlers ...gateway.Handler) {
-	hf, mfs := r.match(r.c, handlers...)
+	hf, mfs := r.route(handlers...)
 	r.routerGroup.GET(path, hf, mfs...)
 }
 
 func (r *routerGroup) CREATE(path string, handlers ...gateway.Handler) {
-	hf, mfs := r.match(r.c, handlers...)
+	hf, mfs := r.route(handlers...)
 	r.routerGroup.POST(path, hf, mfs...)
 }
 
 func (r *routerGroup) UPDATE(path string, handlers ...gateway.Handler) {
-	hf, mfs := r.match(r.c, handlers...)
+	hf, mfs := r.route(handlers...)
 	r.routerGroup.PUT(path, hf, mfs...)
 }
 
 func (r *routerGroup) DELETE(path string, handlers ...gateway.Handler) {
-	hf, mfs := r.match(r.c, handlers...)
+	hf, mfs := r.route(handlers...)
 	r.routerGroup.DELETE(path, hf, mfs...)
 }
 
+func (r *routerGroup) PATCH(path string, handlers ...gateway.Handler) {
+	hf, mfs := r.route(handlers...)
+	r.routerGroup.PATCH(path, hf, mfs...)
+}
+
+func (r *routerGroup) HEAD(path string, handlers ...gateway.Handler) {
+	hf, mfs := r.route(handlers...)
+	r.routerGroup.HEAD(path, hf, mfs...)
+}
+
+func (r *routerGroup) OPTIONS(path string, handlers ...gateway.Handler) {
+	hf, mfs := r.route(handlers...)
+	r.routerGroup.OPTIONS(path, hf, mfs...)
+}
+
+func (r *routerGroup) Handle(method, path string, handlers ...gateway.Handler) {
+	hf, mfs := r.route(handlers...)
+	r.routerGroup.Add(method, path, hf, mfs...)
+}
+
 func (r *routerGroup) STATIC(path string) {
 	r.routerGroup.Use(ew.Static(filepath.Join(path)))
 }
@@ -56,15 +137,87 @@ func (r *routerGroup) ServeHttp(w http.ResponseWriter, req *http.Request) {
 }
 
 func (r *routerGroup) Group(relativePath string) gateway.RouterGroupModel {
-	return &routerGroup{
-		router:      router{config: r.config},
+	g := &routerGroup{
+		router:      r.router,
 		engine:      r.engine,
 		routerGroup: r.routerGroup.Group(relativePath),
 		c:           r.c,
+		prefix:      r.prefix + relativePath,
+		pageSize:    newPageSizeGuard(r.live, r.pageSize),
+		envelope:    newEnvelopeSelector(r.live, r.envelope),
+		middlewares: r.middlewares,
 	}
+	g.useConfiguredMiddlewares()
+	return g
 }
 
 func (r *routerGroup) Middleware(handlers ...gateway.Handler) {
 	mfs := r.matchMiddleware(r.c, handlers...)
 	r.routerGroup.Use(mfs...)
 }
+
+func (r *routerGroup) UseMiddleware(names ...string) error {
+	mfs, err := lookupMiddlewares(r.middlewares, names...)
+	if err != nil {
+		return err
+	}
+	r.routerGroup.Use(mfs...)
+	return nil
+}
+
+func (r *routerGroup) CSRF(sessionType string) error {
+	h, err := newCSRFHandler(r.live, sessionType)
+	if err != nil {
+		return err
+	}
+	r.Middleware(h)
+	return nil
+}
+
+func (r *routerGroup) PageSize(limits PageSizeLimits) {
+	r.pageSize.limits.set(limits)
+}
+
+func (r *routerGroup) Envelope(name string) error {
+	if _, ok := getEnvelope(name); !ok {
+		return fmt.Errorf("envelope %s is not registered", name)
+	}
+	r.envelope.name.set(name)
+	return nil
+}
+
+func (r *routerGroup) Cache(cfg CacheConfig) error {
+	rc, err := newResponseCache(cfg, r.engine, r.c)
+	if err != nil {
+		return err
+	}
+	r.routerGroup.Use(rc.Middleware)
+	return nil
+}
+
+// groupSetting is a setting of a router group that sub groups inherit until
+// they override it. It is resolved per request, so it also applies to routes
+// registered before it was set.
+type groupSetting[T any] struct {
+	parent *groupSetting[T]
+	value  atomic.Pointer[T]
+}
+
+func newGroupSetting[T any](parent *groupSetting[T]) *groupSetting[T] {
+	return &groupSetting[T]{parent: parent}
+}
+
+func (s *groupSetting[T]) set(v T) {
+	s.value.Store(&v)
+}
+
+func (s *groupSetting[T]) get() (T, bool) {
+	if v := s.value.Load(); v != nil {
+		return *v, true
+	}
+	if s.parent != nil {
+		return s.parent.get()
+	}
+	var zero T
+	return zero, false
+}
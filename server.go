@@ -5,7 +5,8 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aliworkshop/configer"
@@ -19,64 +20,148 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// Server extends gateway.ServerModel with the echo specific features of the
+// package.
+type Server interface {
+	gateway.ServerModel
+	// UseMiddleware attaches middlewares configured under the given names to
+	// every route of the server.
+	UseMiddleware(names ...string) error
+	// Reload re-reads the config registry and swaps the hot reloadable
+	// sections. An invalid config is rejected and the current one is kept.
+	Reload() error
+	// OnShutdown registers a hook run by Shutdown after the server stopped
+	// serving. Hooks run in registration order, each with its own timeout,
+	// which defaults to Http.Shutdown.HookTimeout.
+	OnShutdown(name string, hook func(ctx context.Context) error, timeout ...time.Duration)
+	// AddHealthChecker registers a check reported by the readiness endpoint.
+	AddHealthChecker(checker HealthChecker, options HealthCheckOptions)
+	// RegisterValidation adds a validation tag along with its messages. Rules
+	// must be registered before the server runs.
+	RegisterValidation(rule ValidationRule) error
+	// RegisterStructValidation adds a struct level validation for types.
+	RegisterStructValidation(fn validator.StructLevelFunc, types ...any) error
+	// ValidationRules lists the registered rules sorted by tag.
+	ValidationRules() []ValidationRule
+}
+
 type echoServer struct {
 	router
 	server         *echo.Echo
-	config         config
 	configRegistry configer.Registry
 	controller     gateway.Controller
-	validator      *validator.Validate
+	validation     *validation
+	middlewares    map[string]echo.MiddlewareFunc
+	reloader       *hotReloader
+	stop           chan struct{}
+	stopOnce       sync.Once
+	ready          atomic.Bool
+	started        atomic.Bool
+	conns          *connTracker
+	hooks          []shutdownHook
+	hooksMtx       sync.Mutex
+	health         healthRegistry
+	admin          *echo.Echo
+	startedAt      time.Time
 }
 
-func NewServer(configRegistry configer.Registry) gateway.ServerModel {
+func NewServer(configRegistry configer.Registry) Server {
 	var cfg config
 	if err := configRegistry.Unmarshal(&cfg); err != nil {
 		panic(err)
 	}
 	cfg.Initialize()
-	v := validator.New()
+	if err := cfg.validate(); err != nil {
+		panic(err)
+	}
+	vl := newValidation()
 	es := &echoServer{
-		router:         router{config: cfg},
-		config:         cfg,
+		router:         router{live: newLiveConfig(cfg)},
 		configRegistry: configRegistry,
-		validator:      v,
+		validation:     vl,
+		stop:           make(chan struct{}),
+		conns:          newConnTracker(),
+		startedAt:      time.Now(),
 	}
+	es.reloader = &hotReloader{live: es.live}
 	s := echo.New()
 	if !cfg.Development {
 		s.Use(ew.Recover())
 	}
 
-	if es.config.Http.Development {
+	if cfg.Development {
 		s.Use(ew.Logger())
 	} else {
 		l, err := logger.GetLogger(configRegistry.ValueOf("http.logger"))
 		if err != nil {
 			panic("logger for http is not set. set http server config to development")
 		}
-		s.Use(NewLoggerHandler(l, es.config.Http))
-	}
-	s.Use(ew.CORSWithConfig(ew.CORSConfig{
-		AllowOrigins: cfg.Cors.AllowOrigins,
-		AllowMethods: cfg.Cors.AllowMethods,
-		AllowHeaders: cfg.Cors.AllowHeaders,
-	}))
-	s.Validator = &customValidator{validator: v}
+		es.reloader.logger = l
+		es.reloader.accessLog = newSwappableMiddleware(NewLoggerHandler(l, cfg.Http))
+		s.Use(es.reloader.accessLog.Middleware)
+	}
+	if cfg.Pagination.CursorSecret == "" {
+		es.reloader.logf("pagination CursorSecret is not set, cursors are signed with a per-process secret")
+	}
+	es.reloader.cors = newSwappableMiddleware(corsMiddlewareFromConfig(cfg.Http))
+	s.Use(es.reloader.cors.Middleware)
+	s.Use(es.reloader.applyTimeouts)
+	s.Validator = &customValidator{validator: vl.validate}
 	es.server = s
-	es.server.Use(injectValidator(v))
+	es.server.Use(injectValidator(vl))
+	es.server.Use(injectConnTracker(es.conns))
+	es.server.Use(injectPagination(newPagination(es.live)))
+	es.server.Use(injectBodyLimit(es.live))
+	es.server.Use(compressionMiddleware(es.live))
+	if cfg.Admin.Address != "" {
+		es.admin = newAdminServer()
+		es.mountAdmin(es.admin)
+	}
+	es.mountHealth(es.monitoringEngine(), cfg.Health.Path)
+	es.ready.Store(true)
+
+	mfs, err := buildMiddlewares(cfg.middlewareConfig)
+	if err != nil {
+		panic(err)
+	}
+	es.middlewares = make(map[string]echo.MiddlewareFunc, len(mfs))
+	es.reloader.middlewares = make(map[string]*swappableMiddleware, len(mfs))
+	for name, mf := range mfs {
+		sm := newSwappableMiddleware(mf)
+		es.reloader.middlewares[name] = sm
+		es.middlewares[name] = sm.Middleware
+	}
+	global := configuredMiddlewares(cfg.middlewareConfig, func(m middlewareEntry) bool {
+		return m.Global
+	})
+	if err := es.UseMiddleware(global...); err != nil {
+		panic(err)
+	}
 
 	return es
 }
 
-func NewTestServer(c gateway.Controller) gateway.ServerModel {
-	v := validator.New()
+func NewTestServer(c gateway.Controller) Server {
+	vl := newValidation()
 	s := echo.New()
-	s.Validator = &customValidator{validator: v}
-	s.Use(injectValidator(v))
-	return &echoServer{
+	s.Validator = &customValidator{validator: vl.validate}
+	s.Use(injectValidator(vl))
+	es := &echoServer{
+		router:     router{live: newLiveConfig(config{})},
 		server:     s,
 		controller: c,
-		validator:  v,
+		validation: vl,
+		stop:       make(chan struct{}),
+		conns:      newConnTracker(),
+		startedAt:  time.Now(),
 	}
+	es.reloader = &hotReloader{live: es.live}
+	s.Use(injectConnTracker(es.conns))
+	s.Use(injectPagination(newPagination(es.live)))
+	s.Use(injectBodyLimit(es.live))
+	s.Use(compressionMiddleware(es.live))
+	es.ready.Store(true)
+	return es
 }
 
 func (es *echoServer) AddMonitoring(m *gateway.Monitoring) (prometheus.Collector, errors.ErrorModel) {
@@ -95,11 +180,15 @@ func (es *echoServer) AddMonitoring(m *gateway.Monitoring) (prometheus.Collector
 }
 
 func (es *echoServer) StartMonitoring() {
-	p := echop.NewPrometheus("app", func(c echo.Context) bool {
-		return strings.HasSuffix(c.Path(), "monitoring/metrics")
-	})
-	p.MetricsPath = "monitoring/metrics"
-	p.Use(es.server)
+	cfg := es.live.Load()
+	mc := cfg.Metrics
+	mc.initialize()
+	m, err := newHttpMetrics(mc, cfg.ServiceName)
+	if err != nil {
+		panic(err)
+	}
+	es.server.Use(m.middleware(mc.Path))
+	es.monitoringEngine().GET(mc.Path, metricsHandler())
 }
 
 func (es *echoServer) Middleware(handlers ...gateway.Handler) {
@@ -107,8 +196,17 @@ func (es *echoServer) Middleware(handlers ...gateway.Handler) {
 	es.server.Use(mfs...)
 }
 
+func (es *echoServer) UseMiddleware(names ...string) error {
+	mfs, err := lookupMiddlewares(es.middlewares, names...)
+	if err != nil {
+		return err
+	}
+	es.server.Use(mfs...)
+	return nil
+}
+
 func (es *echoServer) Validator() *validator.Validate {
-	return es.validator
+	return es.validation.validate
 }
 
 func (es *echoServer) SetController(controller gateway.Controller) {
@@ -120,7 +218,7 @@ func (es *echoServer) GetController() gateway.Controller {
 }
 
 func (es *echoServer) NewRouterGroup(path string) gateway.RouterGroupModel {
-	return newRouterGroup(es.server, es.controller, es.config, path)
+	return newRouterGroup(es.server, es.controller, es.live, es.middlewares, path)
 }
 
 func (es *echoServer) LoadHtml(path string) {
@@ -130,19 +228,64 @@ func (es *echoServer) LoadHtml(path string) {
 	es.server.Renderer = renderer
 }
 
-func (es *echoServer) Shutdown(timeout time.Duration) error {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-	return es.server.Shutdown(ctx)
-}
-
 func (es *echoServer) Run(addr ...string) error {
 	if len(addr) == 0 {
 		addr = []string{"127.0.0.1:8080"}
 	}
-	err := es.server.Start(addr[0])
+	cfg := es.live.Load()
+	es.started.Store(true)
+	if es.admin != nil {
+		if err := es.startAdmin(); err != nil {
+			return err
+		}
+	}
+	if es.configRegistry != nil {
+		es.subscribeConfig(es.configRegistry, es.stop)
+	}
+	if cfg.ReloadInterval > 0 {
+		go es.watchConfig(cfg.ReloadInterval, es.stop)
+	}
+	var err error
+	if cfg.TLS.Enabled {
+		err = es.runTLS(addr[0], cfg.Http)
+	} else {
+		configureHttpServer(es.server.Server, cfg.Http)
+		es.reloader.serving.Store(es.server.Server)
+		err = es.server.Start(addr[0])
+	}
 	if err != nil && err != http.ErrServerClosed {
+		// Shutdown is not called after a failed start, so the admin
+		// listener and the config watchers are stopped here.
+		es.stopOnce.Do(func() { close(es.stop) })
+		if es.admin != nil {
+			_ = es.admin.Close()
+		}
 		return err
 	}
 	return nil
 }
+
+func (es *echoServer) runTLS(addr string, c Http) error {
+	tlsConfig, err := buildTLSConfig(c.TLS)
+	if err != nil {
+		return err
+	}
+	if !es.server.DisableHTTP2 {
+		tlsConfig.NextProtos = append(tlsConfig.NextProtos, "h2")
+	}
+	s := es.server.TLSServer
+	configureHttpServer(s, c)
+	es.reloader.serving.Store(s)
+	s.Addr = addr
+	s.TLSConfig = tlsConfig
+	return es.server.StartServer(s)
+}
+
+func configureHttpServer(s *http.Server, c Http) {
+	s.ReadTimeout = c.ReadTimeout
+	s.ReadHeaderTimeout = c.ReadHeaderTimeout
+	s.WriteTimeout = c.WriteTimeout
+	s.IdleTimeout = c.IdleTimeout
+	s.MaxHeaderBytes = c.MaxHeaderBytes
+	s.SetKeepAlivesEnabled(!c.DisableKeepAlives)
+}
@@ -1,16 +1,40 @@
 package echoserver
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
 	"github.com/aliworkshop/logger/writers"
+	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/aliworkshop/configer"
+	"github.com/aliworkshop/dfilter"
 	"github.com/aliworkshop/errors"
 	"github.com/aliworkshop/gateway/v2"
 	"github.com/aliworkshop/logger"
+	"github.com/andybalholm/brotli"
+	"github.com/go-playground/validator/v10"
+	"github.com/klauspost/compress/zstd"
+	"github.com/labstack/echo/v4"
 )
 
 type stubLogger struct{}
@@ -153,3 +177,1912 @@ func TestServer_PaginationQueryParams(t *testing.T) {
 		t.Fatalf("paginator parse: page=%d size=%d; want 2/25", seenPage, seenSize)
 	}
 }
+
+func TestRouterGroup_ConfiguredMiddleware(t *testing.T) {
+	cfg := config{middlewareConfig: middlewareConfig{Middlewares: map[string]middlewareEntry{
+		"limit": {Type: "bodylimit", Config: map[string]any{"limit": "4B"}, Groups: []string{"/api"}},
+	}}}
+	mfs, err := buildMiddlewares(cfg.middlewareConfig)
+	if err != nil {
+		t.Fatalf("buildMiddlewares: %v", err)
+	}
+	controller := gateway.NewController(NewResponder(nil), logger.NewSimpleLogger(writers.DebugLevel, logger.JsonEncoding))
+	rg := newRouterGroup(echo.New(), controller, newLiveConfig(cfg), mfs, "/api")
+	rg.CREATE("/widgets", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		return nil, nil
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/widgets", strings.NewReader(`{"name":"too long"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	rg.ServeHttp(rec, req)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d; want 413; body=%s", rec.Code, rec.Body.String())
+	}
+	if _, err := buildMiddlewares(middlewareConfig{Middlewares: map[string]middlewareEntry{
+		"unknown": {Type: "nope"},
+	}}); err == nil {
+		t.Fatalf("expected an error for an unknown middleware type")
+	}
+}
+
+func TestRouterGroup_CSRF(t *testing.T) {
+	var cfg config
+	cfg.Initialize()
+	controller := gateway.NewController(NewResponder(nil), logger.NewSimpleLogger(writers.DebugLevel, logger.JsonEncoding))
+	rg := newRouterGroup(echo.New(), controller, newLiveConfig(cfg), nil, "/admin")
+	if err := rg.CSRF("normal"); err != nil {
+		t.Fatalf("CSRF: %v", err)
+	}
+	rg.READ("/form", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		return CSRFToken(req), nil
+	}))
+	rg.CREATE("/form", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		return "ok", nil
+	}))
+
+	rec := httptest.NewRecorder()
+	rg.ServeHttp(rec, httptest.NewRequest(http.MethodGet, "/admin/form", nil))
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "CSRF_TOKEN_NORMAL" || cookies[0].Value == "" {
+		t.Fatalf("expected a csrf cookie; got %v", cookies)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/form", nil)
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	rg.ServeHttp(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("status = %d; want 403; body=%s", rec.Code, rec.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/admin/form", nil)
+	req.AddCookie(cookies[0])
+	req.Header.Set("X-CSRF-TOKEN-NORMAL", cookies[0].Value)
+	rec = httptest.NewRecorder()
+	rg.ServeHttp(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d; want 201; body=%s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHotReloader_SwapsCorsAndRejectsInvalidConfig(t *testing.T) {
+	var cfg config
+	cfg.Cors.AllowOrigins = []string{"https://a.example"}
+	cfg.Initialize()
+	hr := &hotReloader{live: newLiveConfig(cfg), cors: newSwappableMiddleware(corsMiddlewareFromConfig(cfg.Http))}
+	e := echo.New()
+	e.Use(hr.cors.Middleware)
+	e.GET("/", func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+
+	allowed := func(origin string) string {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(echo.HeaderOrigin, origin)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Header().Get(echo.HeaderAccessControlAllowOrigin)
+	}
+	if got := allowed("https://b.example"); got != "" {
+		t.Fatalf("origin b allowed before reload: %q", got)
+	}
+
+	invalid := cfg
+	invalid.Cors.AllowOrigins = []string{"b.example"}
+	if err := hr.apply(invalid); err == nil {
+		t.Fatalf("expected invalid origin to be rejected")
+	}
+
+	next := cfg
+	next.Cors.AllowOrigins = []string{"https://a.example", "https://b.example"}
+	if err := hr.apply(next); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if got := allowed("https://b.example"); got != "https://b.example" {
+		t.Fatalf("origin b not allowed after reload: %q", got)
+	}
+	if keys := changedKeys(cfg, next); len(keys) != 1 || keys[0] != "Cors" {
+		t.Fatalf("changedKeys = %v; want [Cors]", keys)
+	}
+}
+
+func TestHotReloader_RebuildsChangedMiddlewaresOnly(t *testing.T) {
+	builds := map[string]int{}
+	RegisterMiddleware("reload_counter", func(config any) (echo.MiddlewareFunc, error) {
+		builds[fmt.Sprint(config)]++
+		return passThrough, nil
+	})
+	var cfg config
+	cfg.Middlewares = map[string]middlewareEntry{
+		"a": {Type: "reload_counter", Config: "a1"},
+		"b": {Type: "reload_counter", Config: "b1"},
+	}
+	cfg.Initialize()
+	hr := &hotReloader{
+		live:        newLiveConfig(cfg),
+		cors:        newSwappableMiddleware(corsMiddlewareFromConfig(cfg.Http)),
+		middlewares: map[string]*swappableMiddleware{"a": newSwappableMiddleware(passThrough), "b": newSwappableMiddleware(passThrough)},
+	}
+
+	next := cfg
+	next.Cors.AllowOrigins = []string{"https://a.example"}
+	next.Middlewares = map[string]middlewareEntry{
+		"a": {Type: "reload_counter", Config: "a1"},
+		"b": {Type: "reload_counter", Config: "b2"},
+	}
+	if err := hr.apply(next); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if builds["a1"] != 0 || builds["b2"] != 1 {
+		t.Fatalf("builds = %v; want only b rebuilt", builds)
+	}
+}
+
+func TestServer_ShutdownHooks(t *testing.T) {
+	server := NewTestServer(nil)
+	var order []string
+	var mtx sync.Mutex
+	record := func(name string) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		order = append(order, name)
+	}
+	server.OnShutdown("first", func(ctx context.Context) error {
+		record("first")
+		return nil
+	})
+	server.OnShutdown("slow", func(ctx context.Context) error {
+		record("slow")
+		time.Sleep(time.Second)
+		return nil
+	}, 50*time.Millisecond)
+	server.OnShutdown("last", func(ctx context.Context) error {
+		record("last")
+		return nil
+	})
+
+	err := server.Shutdown(time.Second)
+	if err == nil || !strings.Contains(err.Error(), "slow") {
+		t.Fatalf("expected the slow hook to time out; got %v", err)
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	if strings.Join(order, ",") != "first,slow,last" {
+		t.Fatalf("hooks ran as %v", order)
+	}
+	if server.(*echoServer).ready.Load() {
+		t.Fatalf("expected readiness to be flipped")
+	}
+}
+
+func TestServer_HealthEndpoints(t *testing.T) {
+	es := NewTestServer(nil).(*echoServer)
+	es.mountHealth(es.server, "/monitoring/health")
+	es.AddHealthChecker(HealthCheckerFunc("cache", func(ctx context.Context) error {
+		return fmt.Errorf("cache is down")
+	}), HealthCheckOptions{})
+
+	ready := func() (int, HealthReport) {
+		rec := httptest.NewRecorder()
+		es.server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/monitoring/health/ready", nil))
+		var resp struct {
+			Items HealthReport
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("unmarshal: %v; body=%s", err, rec.Body.String())
+		}
+		return rec.Code, resp.Items
+	}
+	if code, report := ready(); code != http.StatusOK || report.Status != HealthDegraded {
+		t.Fatalf("ready = %d %s; want 200 degraded", code, report.Status)
+	}
+
+	es.AddHealthChecker(HealthCheckerFunc("db", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}), HealthCheckOptions{Critical: true, Timeout: 10 * time.Millisecond})
+	if code, report := ready(); code != http.StatusServiceUnavailable || report.Status != HealthDown || len(report.Checks) != 2 {
+		t.Fatalf("ready = %d %+v; want 503 down", code, report)
+	}
+
+	rec := httptest.NewRecorder()
+	es.server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/monitoring/health/live", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("live = %d; want 200", rec.Code)
+	}
+}
+
+func TestServer_StartMonitoring(t *testing.T) {
+	rg, server := newTestRouter(t, "/api")
+	server.StartMonitoring()
+	rg.READ("/items/:id", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		return nil, errors.NotFound()
+	}))
+
+	rec := httptest.NewRecorder()
+	rg.ServeHttp(rec, httptest.NewRequest(http.MethodGet, "/api/items/7", nil))
+	rec = httptest.NewRecorder()
+	rg.ServeHttp(rec, httptest.NewRequest(http.MethodGet, "/monitoring/metrics", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d; want 200", rec.Code)
+	}
+	for _, want := range []string{
+		`app_requests_total{code="404",host="example.com",method="GET",url="/api/items/:id"} 1`,
+		`app_request_duration_seconds_count{code="404",method="GET",url="/api/items/:id"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Fatalf("metrics do not contain %s", want)
+		}
+	}
+}
+
+func TestHttpMetrics_ConfiguredLabels(t *testing.T) {
+	mc := MetricsConfig{Namespace: "labels_test", Labels: []string{"route", "method", "status", "service"}}
+	mc.initialize()
+	m, err := newHttpMetrics(mc, "catalog")
+	if err != nil {
+		t.Fatalf("newHttpMetrics: %v", err)
+	}
+	e := echo.New()
+	e.Use(m.middleware(mc.Path))
+	e.GET("/items/:id", func(c echo.Context) error { return c.NoContent(http.StatusNoContent) })
+	e.GET(mc.Path, metricsHandler())
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/items/7", nil))
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, mc.Path, nil))
+
+	want := `labels_test_app_requests_total{method="GET",route="/items/:id",service="catalog",status="2xx"} 1`
+	if !strings.Contains(rec.Body.String(), want) {
+		t.Fatalf("metrics do not contain %s", want)
+	}
+	if _, err := newHttpMetrics(MetricsConfig{Labels: []string{"path"}}, ""); err == nil {
+		t.Fatalf("expected an unknown label to be rejected")
+	}
+}
+
+type widget struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+	Note string   `json:"note,omitempty"`
+}
+
+func TestServer_PATCH(t *testing.T) {
+	rg, _ := newTestRouter(t, "/api")
+	rg.(RouterGroup).PATCH("/widgets/:id", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		w := &widget{Name: "old", Tags: []string{"a"}, Note: "keep"}
+		if err := req.(Requester).BindPatch(w); err != nil {
+			return nil, err
+		}
+		return w, nil
+	}))
+
+	cases := []struct {
+		contentType, body string
+		want              widget
+	}{
+		{MIMEMergePatch, `{"name":"new","note":null}`, widget{Name: "new", Tags: []string{"a"}}},
+		{MIMEJSONPatch, `[{"op":"add","path":"/tags/-","value":"b"},{"op":"test","path":"/name","value":"old"}]`,
+			widget{Name: "old", Tags: []string{"a", "b"}, Note: "keep"}},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodPatch, "/api/widgets/1", strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", tc.contentType)
+		rec := httptest.NewRecorder()
+		rg.ServeHttp(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d; want 200; body=%s", tc.contentType, rec.Code, rec.Body.String())
+		}
+		var resp struct{ Items widget }
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		if !reflect.DeepEqual(resp.Items, tc.want) {
+			t.Fatalf("%s: got %+v; want %+v", tc.contentType, resp.Items, tc.want)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPatch, "/api/widgets/1", strings.NewReader(`[{"op":"test","path":"/name","value":"x"}]`))
+	req.Header.Set("Content-Type", MIMEJSONPatch)
+	rec := httptest.NewRecorder()
+	rg.ServeHttp(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("failed test op: status = %d; want 400", rec.Code)
+	}
+}
+
+func TestServer_ContentNegotiation(t *testing.T) {
+	rg, _ := newTestRouter(t, "/api")
+	rg.READ("/ping", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		return map[string]bool{"pong": true}, nil
+	}))
+
+	cases := []struct {
+		accept, contentType string
+		code                int
+	}{
+		{"", echo.MIMEApplicationJSONCharsetUTF8, http.StatusOK},
+		{"application/xml;q=0.5, application/msgpack", MIMEApplicationMsgpack, http.StatusOK},
+		{"application/cbor, */*;q=0.1", MIMEApplicationCBOR, http.StatusOK},
+		{"application/msgpack;q=0.9, */*;q=0.1", MIMEApplicationMsgpack, http.StatusOK},
+		{"text/html", echo.MIMEApplicationJSONCharsetUTF8, http.StatusOK},
+		{"application/xml", echo.MIMEApplicationXML, http.StatusOK},
+		// browsers list xml below q=1 next to a wildcard
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", echo.MIMEApplicationJSONCharsetUTF8, http.StatusOK},
+		// maps have no protobuf representation
+		{"application/x-protobuf", echo.MIMETextPlainCharsetUTF8, http.StatusNotAcceptable},
+		{"application/x-protobuf, application/json;q=0.5", echo.MIMEApplicationJSONCharsetUTF8, http.StatusOK},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/api/ping", nil)
+		req.Header.Set("Accept", tc.accept)
+		rec := httptest.NewRecorder()
+		rg.ServeHttp(rec, req)
+		if got := rec.Header().Get("Content-Type"); got != tc.contentType || rec.Code != tc.code {
+			t.Fatalf("Accept %q: status = %d, content type = %q; want %d, %q", tc.accept, rec.Code, got, tc.code, tc.contentType)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/ping", nil)
+	req.Header.Set("Accept", "application/xml")
+	rec := httptest.NewRecorder()
+	rg.ServeHttp(rec, req)
+	want := xml.Header + "<response><items><pong>true</pong></items><page>"
+	if !strings.HasPrefix(rec.Body.String(), want) || xml.Unmarshal(rec.Body.Bytes(), new(any)) != nil {
+		t.Fatalf("xml body = %s; want it to start with %s", rec.Body.String(), want)
+	}
+
+	rg.READ("/missing", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		return nil, errors.NotFound()
+	}))
+	req = httptest.NewRequest(http.MethodGet, "/api/missing", nil)
+	req.Header.Set("Accept", "application/x-protobuf")
+	rec = httptest.NewRecorder()
+	rg.ServeHttp(rec, req)
+	if rec.Code != http.StatusNotFound || !strings.HasPrefix(rec.Header().Get("Content-Type"), echo.MIMEApplicationJSON) {
+		t.Fatalf("protobuf error: status = %d, content type = %q; want 404 json", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	h := make(http.Header)
+	protobufEncoder{}.EncodeHeaders(h, gateway.Response{Page: 2, PerPage: 10, Total: 35})
+	if h.Get("X-Page") != "2" || h.Get("X-Page-Size") != "10" || h.Get("X-Total-Count") != "35" {
+		t.Fatalf("protobuf envelope headers = %v", h)
+	}
+}
+
+func TestServer_BodyLimit(t *testing.T) {
+	var cfg config
+	cfg.Initialize()
+	cfg.MaxBodyBytes = 64
+	live := newLiveConfig(cfg)
+	e := echo.New()
+	e.Use(injectBodyLimit(live))
+	controller := gateway.NewController(NewResponder(nil), logger.NewSimpleLogger(writers.DebugLevel, logger.JsonEncoding))
+	rg := newRouterGroup(e, controller, live, nil, "/api")
+	rg.CREATE("/widgets", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		var w bindableWidget
+		if err := req.BindRequest(&w); err != nil {
+			return nil, err
+		}
+		return w, nil
+	}))
+	rg.PATCH("/widgets", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		w := &widget{}
+		if err := req.(Requester).BindPatch(w); err != nil {
+			return nil, err
+		}
+		return w, nil
+	}))
+
+	name := strings.Repeat("x", 100)
+	var msgpackBody, cborBody bytes.Buffer
+	if err := encodeMsgpack(&msgpackBody, widget{Name: name}); err != nil {
+		t.Fatalf("msgpack: %v", err)
+	}
+	if err := encodeCBOR(&cborBody, widget{Name: name}); err != nil {
+		t.Fatalf("cbor: %v", err)
+	}
+	for _, tc := range []struct {
+		method, contentType string
+		body                []byte
+	}{
+		{http.MethodPost, echo.MIMEApplicationJSON, []byte(`{"name":"` + name + `"}`)},
+		{http.MethodPost, MIMEApplicationMsgpack, msgpackBody.Bytes()},
+		{http.MethodPost, MIMEApplicationCBOR, cborBody.Bytes()},
+		{http.MethodPost, MIMEApplicationYAML, []byte("name: " + name)},
+		{http.MethodPatch, MIMEMergePatch, []byte(`{"name":"` + name + `"}`)},
+	} {
+		req := httptest.NewRequest(tc.method, "/api/widgets", bytes.NewReader(tc.body))
+		req.Header.Set("Content-Type", tc.contentType)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != http.StatusRequestEntityTooLarge || !strings.Contains(rec.Body.String(), `"request_too_large"`) {
+			t.Fatalf("%s %s: status = %d; want 413; body=%s", tc.method, tc.contentType, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestServer_BindRequestDecoders(t *testing.T) {
+	rg, _ := newTestRouter(t, "/api")
+	rg.CREATE("/widgets", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		var w bindableWidget
+		if err := req.BindRequest(&w); err != nil {
+			return nil, err
+		}
+		return w, nil
+	}))
+
+	var msgpackBody, cborBody bytes.Buffer
+	if err := encodeMsgpack(&msgpackBody, widget{Name: "gear", Tags: []string{"a", "b"}}); err != nil {
+		t.Fatalf("encodeMsgpack: %v", err)
+	}
+	if err := encodeCBOR(&cborBody, widget{Name: "gear", Tags: []string{"a", "b"}}); err != nil {
+		t.Fatalf("encodeCBOR: %v", err)
+	}
+	for contentType, body := range map[string][]byte{
+		MIMEApplicationMsgpack: msgpackBody.Bytes(),
+		MIMEApplicationCBOR:    cborBody.Bytes(),
+		MIMEApplicationYAML:    []byte("name: gear\ntags: [a, b]\n"),
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/widgets", bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		rg.ServeHttp(rec, req)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("%s: status = %d; want 201; body=%s", contentType, rec.Code, rec.Body.String())
+		}
+		var resp struct{ Items widget }
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		if resp.Items.Name != "gear" || len(resp.Items.Tags) != 2 {
+			t.Fatalf("%s: decoded %+v", contentType, resp.Items)
+		}
+	}
+
+	// declared lengths beyond the body and deep nesting are rejected before
+	// anything is allocated for them
+	for name, tc := range map[string]struct {
+		contentType string
+		body        []byte
+	}{
+		"cbor text of 1<<40 bytes":   {MIMEApplicationCBOR, []byte{0x7b, 0, 0, 1, 0, 0, 0, 0, 0}},
+		"cbor nesting":               {MIMEApplicationCBOR, bytes.Repeat([]byte{0x81}, 100000)},
+		"msgpack str of 4GiB":        {MIMEApplicationMsgpack, []byte{0xdb, 0xff, 0xff, 0xff, 0xff}},
+		"msgpack map of 2^32 pairs":  {MIMEApplicationMsgpack, []byte{0xdf, 0xff, 0xff, 0xff, 0xff, 0xa1, 'a'}},
+		"msgpack nesting":            {MIMEApplicationMsgpack, bytes.Repeat([]byte{0x91}, 100000)},
+		"msgpack trailing data":      {MIMEApplicationMsgpack, append(msgpackBody.Bytes(), 0xc0)},
+		"msgpack invalid format":     {MIMEApplicationMsgpack, []byte{0xc1}},
+		"cbor truncated array items": {MIMEApplicationCBOR, []byte{0x9a, 0xff, 0xff, 0xff, 0xff, 0x01}},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/widgets", bytes.NewReader(tc.body))
+		req.Header.Set("Content-Type", tc.contentType)
+		rec := httptest.NewRecorder()
+		rg.ServeHttp(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: status = %d; want 400; body=%s", name, rec.Code, rec.Body.String())
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/widgets", strings.NewReader("name: gear"))
+	req.Header.Set("Content-Type", "application/unknown")
+	rec := httptest.NewRecorder()
+	rg.ServeHttp(rec, req)
+	if rec.Code != http.StatusUnsupportedMediaType || !strings.Contains(rec.Body.String(), `"unsupported_media_type"`) {
+		t.Fatalf("status = %d; want 415 unsupported_media_type; body=%s", rec.Code, rec.Body.String())
+	}
+}
+
+type bindableWidget widget
+
+func (w *bindableWidget) Validate(*validator.Validate, gateway.Language) errors.ErrorModel {
+	return nil
+}
+
+func TestServer_ProblemDetails(t *testing.T) {
+	controller := gateway.NewController(NewResponder(nil, WithProblemDetails("https://errors.example.com/")), logger.NewSimpleLogger(writers.DebugLevel, logger.JsonEncoding))
+	rg := NewTestServer(controller).NewRouterGroup("/api")
+	rg.READ("/missing", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		return nil, errors.NotFound().WithMessage("widget not found").WithProperty("widget", "gear")
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/missing", nil)
+	rec := httptest.NewRecorder()
+	rg.ServeHttp(rec, req)
+
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("status = %d; want 404; body=%s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != MIMEApplicationProblemJSON {
+		t.Fatalf("Content-Type = %q; want %s", ct, MIMEApplicationProblemJSON)
+	}
+	var problem map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("unmarshal: %v; body=%s", err, rec.Body.String())
+	}
+	if problem["status"] != float64(http.StatusNotFound) || problem["title"] != "Not Found" ||
+		problem["detail"] != "widget not found" || problem["widget"] != "gear" {
+		t.Fatalf("problem = %v", problem)
+	}
+	if typ, _ := problem["type"].(string); !strings.HasPrefix(typ, "https://errors.example.com/") {
+		t.Fatalf("type = %q", typ)
+	}
+	if instance, _ := problem["instance"].(string); instance != "urn:uuid:"+rec.Header().Get("X-Request-Uuid") {
+		t.Fatalf("instance = %q", instance)
+	}
+
+	// Without the option, clients can still ask for the problem format.
+	plain, _ := newTestRouter(t, "/api")
+	plain.READ("/missing", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		return nil, errors.NotFound()
+	}))
+	req = httptest.NewRequest(http.MethodGet, "/api/missing", nil)
+	req.Header.Set("Accept", MIMEApplicationProblemJSON)
+	rec = httptest.NewRecorder()
+	plain.ServeHttp(rec, req)
+	if ct := rec.Header().Get("Content-Type"); ct != MIMEApplicationProblemJSON {
+		t.Fatalf("Content-Type = %q; want %s", ct, MIMEApplicationProblemJSON)
+	}
+}
+
+func TestServer_StatusRegistry(t *testing.T) {
+	for status, want := range map[gateway.Status]int{
+		gateway.StatusOK:      http.StatusOK,
+		StatusAccepted:        http.StatusAccepted,
+		StatusPartialContent:  http.StatusPartialContent,
+		StatusNotModified:     http.StatusNotModified,
+		gateway.StatusUnknown: http.StatusNotImplemented,
+	} {
+		if code := getStatusCode(status); code != want {
+			t.Fatalf("getStatusCode(%v) = %d; want %d", status, code, want)
+		}
+	}
+	for typ, want := range map[errors.Type]int{
+		errors.TypeTooManyRequests: http.StatusTooManyRequests,
+		TypeMethodNotAllowed:       http.StatusMethodNotAllowed,
+		TypeRequestTimeout:         http.StatusRequestTimeout,
+		TypeGone:                   http.StatusGone,
+		TypePreconditionFailed:     http.StatusPreconditionFailed,
+		TypeRequestTooLarge:        http.StatusRequestEntityTooLarge,
+		TypeUnsupportedMediaType:   http.StatusUnsupportedMediaType,
+		TypeUnprocessable:          http.StatusUnprocessableEntity,
+		TypeLocked:                 http.StatusLocked,
+		TypeFailedDependency:       http.StatusFailedDependency,
+		TypeUnavailable:            http.StatusServiceUnavailable,
+		TypeTimeout:                http.StatusGatewayTimeout,
+	} {
+		errorStatusMapMtx.RLock()
+		es := errorStatusMap[typ]
+		errorStatusMapMtx.RUnlock()
+		if es.Code != want {
+			t.Fatalf("errorStatusMap[%v] = %d; want %d", typ, es.Code, want)
+		}
+	}
+
+	err := WithStatusCode(errors.Validation(), http.StatusUnprocessableEntity)
+	for _, derived := range []errors.ErrorModel{err.Clone(), err.WithMessage("bad"), err.WithProperty("field", "name")} {
+		if code := getErrorStatus(derived).Code; code != http.StatusUnprocessableEntity {
+			t.Fatalf("derived status error code = %d; want %d", code, http.StatusUnprocessableEntity)
+		}
+	}
+
+	RegisterStatusCode(gateway.StatusCreated, http.StatusAccepted)
+	defer RegisterStatusCode(gateway.StatusCreated, http.StatusCreated)
+	RegisterErrorStatus(errors.TypeForbidden, http.StatusLocked, http.Header{"X-Lock": {"held"}})
+	defer RegisterErrorStatus(errors.TypeForbidden, http.StatusForbidden, nil)
+
+	rg, _ := newTestRouter(t, "/api")
+	rg.CREATE("/jobs", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		return map[string]string{"job": "1"}, nil
+	}))
+	rg.READ("/locked", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		return nil, errors.Forbidden()
+	}))
+	rg.READ("/private", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		return nil, errors.UnAuthorized()
+	}))
+	rg.READ("/gone", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		return nil, NewTypedError(TypeGone, "gone", fmt.Errorf("the item was removed")).WithProperty("item", 1)
+	}))
+
+	for _, tc := range []struct {
+		method, path, header, value string
+		code                        int
+	}{
+		{http.MethodPost, "/api/jobs", "", "", http.StatusAccepted},
+		{http.MethodGet, "/api/locked", "X-Lock", "held", http.StatusLocked},
+		{http.MethodGet, "/api/private", "WWW-Authenticate", "Bearer", http.StatusUnauthorized},
+		{http.MethodGet, "/api/gone", "", "", http.StatusGone},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		rec := httptest.NewRecorder()
+		rg.ServeHttp(rec, req)
+		if rec.Code != tc.code {
+			t.Fatalf("%s %s: status = %d; want %d", tc.method, tc.path, rec.Code, tc.code)
+		}
+		if tc.header != "" && rec.Header().Get(tc.header) != tc.value {
+			t.Fatalf("%s %s: %s = %q; want %q", tc.method, tc.path, tc.header, rec.Header().Get(tc.header), tc.value)
+		}
+	}
+}
+
+func TestNewTypedError(t *testing.T) {
+	err := NewTypedError(TypePreconditionFailed, "precondition_failed", fmt.Errorf("stale")).Clone().WithMessage("stale version")
+	if err.Type() != TypePreconditionFailed || err.Id() != "precondition_failed" || err.Message() != "stale version" {
+		t.Fatalf("type = %v, id = %q, message = %q", err.Type(), err.Id(), err.Message())
+	}
+	b, _ := json.Marshal(err)
+	var body map[string]any
+	if json.Unmarshal(b, &body) != nil || body["id"] != "precondition_failed" {
+		t.Fatalf("body = %s", b)
+	}
+}
+
+// The statuses and error types of the package must stay above the values of
+// gateway and errors, which number their own from zero.
+func TestStatusValuesDoNotCollide(t *testing.T) {
+	ownStatuses := []gateway.Status{StatusAccepted, StatusPartialContent, StatusNotModified}
+	for _, upstream := range []gateway.Status{
+		gateway.StatusUnknown, gateway.StatusOK, gateway.StatusCreated, gateway.StatusNoContent,
+		gateway.StatusMovedPermanently, gateway.StatusFound, gateway.StatusPermanentRedirect,
+		gateway.StatusTemporaryRedirect, gateway.StatusBadInput, gateway.StatusConflict,
+	} {
+		for _, own := range ownStatuses {
+			if upstream >= own {
+				t.Fatalf("gateway status %d collides with or exceeds %d", upstream, own)
+			}
+		}
+	}
+	ownTypes := []errors.Type{
+		TypeMethodNotAllowed, TypeRequestTimeout, TypeGone, TypePreconditionFailed, TypeRequestTooLarge,
+		TypeUnsupportedMediaType, TypeUnprocessable, TypeLocked, TypeFailedDependency, TypeUnavailable, TypeTimeout,
+	}
+	for _, upstream := range []errors.Type{
+		errors.TypeInternal, errors.TypeValidation, errors.TypeNotFound, errors.TypeUnAuthorized,
+		errors.TypeForbidden, errors.TypeTooManyRequests, errors.TypeDuplicate,
+	} {
+		for _, own := range ownTypes {
+			if upstream >= own {
+				t.Fatalf("errors type %d collides with or exceeds %d", upstream, own)
+			}
+		}
+	}
+}
+
+type signupForm struct {
+	Email   string `json:"email" validate:"required,email"`
+	Address struct {
+		Street string `json:"street" validate:"required"`
+	} `json:"address"`
+	Age int `json:"age" validate:"gte=18"`
+}
+
+func (f *signupForm) Validate(*validator.Validate, gateway.Language) errors.ErrorModel {
+	return nil
+}
+
+func (f *signupForm) ValidateTags() bool {
+	return true
+}
+
+// legacyForm validates itself, so its tags are not checked by BindRequest.
+type legacyForm struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+func (f *legacyForm) Validate(v *validator.Validate, _ gateway.Language) errors.ErrorModel {
+	if f.Email == "" {
+		return errors.Validation().WithProperty("error", "email is missing")
+	}
+	return nil
+}
+
+func TestServer_ValidationFieldErrors(t *testing.T) {
+	var fields []FieldError
+	rg, _ := newTestRouter(t, "/api")
+	rg.CREATE("/signup", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		var form signupForm
+		err := req.BindRequest(&form)
+		if err != nil {
+			fields, _ = err.Properties()["fields"].([]FieldError)
+		}
+		return nil, err
+	}))
+
+	for lang, want := range map[string]string{"en-US": "email is a required field", "fa-IR": "فیلد email اجباری میباشد"} {
+		req := httptest.NewRequest(http.MethodPost, "/api/signup", strings.NewReader(`{"age":12}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept-Language", lang)
+		rec := httptest.NewRecorder()
+		rg.ServeHttp(rec, req)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("status = %d; want 400; body=%s", rec.Code, rec.Body.String())
+		}
+		got := map[string]FieldError{}
+		for _, f := range fields {
+			got[f.Field] = f
+		}
+		if len(got) != 3 || got["address.street"].Tag != "required" || got["age"].Param != "18" {
+			t.Fatalf("fields = %+v", fields)
+		}
+		if got["email"].Message != want {
+			t.Fatalf("%s: message = %q; want %q", lang, got["email"].Message, want)
+		}
+	}
+
+	err := newValidation().validate.Struct(&legacyForm{})
+	if verrs, ok := err.(validator.ValidationErrors); !ok || verrs[0].Field() != "Email" {
+		t.Fatalf("plain validation error = %v; want Go field names", err)
+	}
+
+	rg.CREATE("/legacy", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		var form legacyForm
+		if err := req.BindRequest(&form); err != nil {
+			return nil, err
+		}
+		return form, nil
+	}))
+	for body, want := range map[string]int{`{"email":"not-an-email"}`: http.StatusCreated, `{}`: http.StatusBadRequest} {
+		req := httptest.NewRequest(http.MethodPost, "/api/legacy", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		rg.ServeHttp(rec, req)
+		if rec.Code != want {
+			t.Fatalf("legacy %s: status = %d; want %d; body=%s", body, rec.Code, want, rec.Body.String())
+		}
+		if want == http.StatusBadRequest && !strings.Contains(rec.Body.String(), "email is missing") {
+			t.Fatalf("legacy %s: body = %s; want the Validate error", body, rec.Body.String())
+		}
+	}
+}
+
+type accountForm struct {
+	Slug     string `json:"slug" validate:"slug"`
+	Phone    string `json:"phone" validate:"phone"`
+	Currency string `json:"currency" validate:"iso4217"`
+	Seats    int    `json:"seats" validate:"even"`
+}
+
+func (f *accountForm) ValidateTags() bool {
+	return true
+}
+
+func (f *accountForm) Validate(*validator.Validate, gateway.Language) errors.ErrorModel {
+	return nil
+}
+
+func TestServer_RegisterValidation(t *testing.T) {
+	controller := gateway.NewController(NewResponder(nil), logger.NewSimpleLogger(writers.DebugLevel, logger.JsonEncoding))
+	server := NewTestServer(controller)
+	err := server.RegisterValidation(ValidationRule{
+		Tag: "even",
+		Func: func(fl validator.FieldLevel) bool {
+			return fl.Field().Int()%2 == 0
+		},
+		Message:      "{0} must be even",
+		Translations: map[string]string{"fa": "{0} باید زوج باشد"},
+		Description:  "even integer",
+	})
+	if err != nil {
+		t.Fatalf("RegisterValidation: %v", err)
+	}
+
+	var fields []FieldError
+	rg := server.NewRouterGroup("/api")
+	rg.CREATE("/accounts", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		var form accountForm
+		err := req.BindRequest(&form)
+		if err != nil {
+			fields, _ = err.Properties()["fields"].([]FieldError)
+		}
+		return nil, err
+	}))
+
+	body := `{"slug":"Not A Slug","phone":"0912","currency":"XXY","seats":3}`
+	req := httptest.NewRequest(http.MethodPost, "/api/accounts", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	rg.ServeHttp(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d; want 400; body=%s", rec.Code, rec.Body.String())
+	}
+	got := map[string]string{}
+	for _, f := range fields {
+		got[f.Tag] = f.Message
+	}
+	want := map[string]string{
+		"slug":    "slug must be a valid slug",
+		"phone":   "phone must be a valid E.164 formatted phone number",
+		"iso4217": "currency must be a valid ISO 4217 currency code",
+		"even":    "seats must be even",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("messages = %v; want %v", got, want)
+	}
+
+	var tags []string
+	for _, rule := range server.ValidationRules() {
+		tags = append(tags, rule.Tag)
+	}
+	if !reflect.DeepEqual(tags, []string{"e164", "even", "iso4217", "phone", "slug", "timezone", "ulid"}) {
+		t.Fatalf("rules = %v", tags)
+	}
+
+	server.(*echoServer).started.Store(true)
+	if err := server.RegisterValidation(ValidationRule{Tag: "late", Func: func(validator.FieldLevel) bool { return true }}); err == nil {
+		t.Fatalf("expected an error registering a rule on a running server")
+	}
+}
+
+func TestServer_CursorPagination(t *testing.T) {
+	ids := []int{1, 2, 3, 4, 5}
+	rg, _ := newTestRouter(t, "/api")
+	rg.READ("/items", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		p, ok := req.Paginator().(*CursorPaginator)
+		if !ok {
+			t.Fatalf("paginator = %T; want *CursorPaginator", req.Paginator())
+		}
+		var after int
+		if err := p.Cursor(&after); err != nil {
+			return nil, err
+		}
+		var page []int
+		for _, id := range ids {
+			if id > after && len(page) < p.Limit() {
+				page = append(page, id)
+			}
+		}
+		if last := page[len(page)-1]; last < ids[len(ids)-1] {
+			p.SetNextCursor(last)
+		}
+		if after > 0 {
+			p.SetPrevCursor(after - p.Limit())
+		}
+		return page, nil
+	}))
+
+	get := func(target string) (*httptest.ResponseRecorder, CursorResponse) {
+		rec := httptest.NewRecorder()
+		rg.ServeHttp(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		var resp CursorResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("unmarshal: %v; body=%s", err, rec.Body.String())
+		}
+		return rec, resp
+	}
+
+	rec, resp := get("/api/items?$limit=2")
+	if resp.Limit != 2 || resp.NextCursor == "" || resp.PrevCursor != "" {
+		t.Fatalf("first page = %+v", resp)
+	}
+	if link := rec.Header().Get("Link"); !strings.Contains(link, `rel="next"`) || strings.Contains(link, `rel="prev"`) {
+		t.Fatalf("Link = %q", link)
+	}
+
+	rec, resp = get("/api/items?$limit=2&$cursor=" + resp.NextCursor)
+	if items := resp.Items.([]any); len(items) != 2 || items[0] != float64(3) {
+		t.Fatalf("second page = %+v", resp)
+	}
+	if link := rec.Header().Get("Link"); !strings.Contains(link, `rel="prev"`) || !strings.Contains(link, `rel="next"`) {
+		t.Fatalf("Link = %q", link)
+	}
+
+	tampered := resp.NextCursor + "x"
+	rec = httptest.NewRecorder()
+	rg.ServeHttp(rec, httptest.NewRequest(http.MethodGet, "/api/items?$cursor="+tampered, nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("tampered cursor: status = %d; want 400", rec.Code)
+	}
+}
+
+func TestServer_PageSizeLimits(t *testing.T) {
+	var cfg config
+	cfg.Initialize()
+	cfg.Pagination.PageSize = PageSizeLimits{Default: 20, Max: 50}
+	controller := gateway.NewController(NewResponder(nil), logger.NewSimpleLogger(writers.DebugLevel, logger.JsonEncoding))
+	rg := newRouterGroup(echo.New(), controller, newLiveConfig(cfg), nil, "/api")
+	strict := rg.Group("/strict").(RouterGroup)
+	strict.PageSize(PageSizeLimits{Max: 10, Reject: true})
+
+	var seenSize int
+	list := handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		p := req.Paginator()
+		seenSize = p.GetPageSize()
+		p.SetTotal(95)
+		return []int{1, 2, 3}, nil
+	})
+	rg.READ("/items", list)
+	strict.READ("/items", list)
+
+	for _, tc := range []struct {
+		target   string
+		code     int
+		wantSize int
+	}{
+		{"/api/items", http.StatusOK, 20},
+		{"/api/items?$page_size=1000000", http.StatusOK, 50},
+		{"/api/items?$page_size=0", http.StatusOK, 20},
+		{"/api/strict/items?$page_size=5", http.StatusOK, 5},
+		{"/api/strict/items?$page_size=11", http.StatusBadRequest, 0},
+	} {
+		seenSize = 0
+		rec := httptest.NewRecorder()
+		rg.ServeHttp(rec, httptest.NewRequest(http.MethodGet, tc.target, nil))
+		if rec.Code != tc.code || seenSize != tc.wantSize {
+			t.Fatalf("%s: status = %d, size = %d; want %d, %d; body=%s", tc.target, rec.Code, seenSize, tc.code, tc.wantSize, rec.Body.String())
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	rg.ServeHttp(rec, httptest.NewRequest(http.MethodGet, "/api/items?$page=2&$page_size=10", nil))
+	if got := rec.Header().Get("X-Total-Count"); got != "95" {
+		t.Fatalf("X-Total-Count = %q; want 95", got)
+	}
+	link := rec.Header().Get("Link")
+	for _, want := range []string{
+		`</api/items?%24page=1&%24page_size=10>; rel="first"`,
+		`</api/items?%24page=1&%24page_size=10>; rel="prev"`,
+		`</api/items?%24page=3&%24page_size=10>; rel="next"`,
+		`</api/items?%24page=10&%24page_size=10>; rel="last"`,
+	} {
+		if !strings.Contains(link, want) {
+			t.Fatalf("Link = %q; missing %s", link, want)
+		}
+	}
+}
+
+func TestServer_FilterHandler(t *testing.T) {
+	var conditions []FilterCondition
+	rg, _ := newTestRouter(t, "/api")
+	rg.READ("/products", NewFilterHandler(FilterConfig{
+		Fields: []FilterField{
+			{Name: "price", Type: FilterFloat},
+			{Name: "status", Column: "state", Operators: []string{FilterEq, FilterIn}},
+			{Name: "name", Operators: []string{FilterLike}},
+		},
+		Converter: func(cs []FilterCondition) ([]dfilter.Filter, error) {
+			return make([]dfilter.Filter, len(cs)), nil
+		},
+	}), handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		conditions = FilterConditions(req)
+		if len(req.GetDynamicFilters()) != len(conditions) {
+			t.Fatalf("dynamic filters = %d; want %d", len(req.GetDynamicFilters()), len(conditions))
+		}
+		return []int{}, nil
+	}))
+
+	rec := httptest.NewRecorder()
+	rg.ServeHttp(rec, httptest.NewRequest(http.MethodGet, "/api/products?price[gte]=10&status[in]=a,b&name[like]=foo&q=free&$page=1", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d; want 200; body=%s", rec.Code, rec.Body.String())
+	}
+	want := []FilterCondition{
+		{Field: "name", Operator: FilterLike, Value: "foo"},
+		{Field: "price", Operator: FilterGte, Value: float64(10)},
+		{Field: "state", Operator: FilterIn, Value: []any{"a", "b"}},
+	}
+	if !reflect.DeepEqual(conditions, want) {
+		t.Fatalf("conditions = %#v; want %#v", conditions, want)
+	}
+
+	for _, target := range []string{
+		"/api/products?secret[eq]=1",
+		"/api/products?status[like]=a",
+		"/api/products?price[gt]=cheap",
+	} {
+		rec := httptest.NewRecorder()
+		rg.ServeHttp(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: status = %d; want 400", target, rec.Code)
+		}
+	}
+}
+
+func TestServer_FilterHandlerDynamicFilters(t *testing.T) {
+	var filters []dfilter.Filter
+	rg, _ := newTestRouter(t, "/api")
+	rg.READ("/products", NewFilterHandler(FilterConfig{
+		Fields: []FilterField{{Name: "price", Column: "amount", Type: FilterInt}},
+	}), handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		filters = req.GetDynamicFilters()
+		return []int{}, nil
+	}))
+
+	rec := httptest.NewRecorder()
+	rg.ServeHttp(rec, httptest.NewRequest(http.MethodGet, "/api/products?price[lt]=20", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d; want 200; body=%s", rec.Code, rec.Body.String())
+	}
+	want := []dfilter.Filter{{Field: "amount", Op: FilterLt, Value: int64(20)}}
+	if !reflect.DeepEqual(filters, want) {
+		t.Fatalf("dynamic filters = %#v; want %#v", filters, want)
+	}
+}
+
+func TestServer_SortHandler(t *testing.T) {
+	var fields []SortField
+	rg, _ := newTestRouter(t, "/api")
+	rg.READ("/posts", NewSortHandler(SortConfig{
+		Fields:  []string{"created_at", "name"},
+		Columns: map[string]string{"created_at": "createdAt"},
+		Default: "-created_at",
+		MaxKeys: 2,
+	}), handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		fields = SortFields(req)
+		return []int{}, nil
+	}))
+
+	for target, want := range map[string][]SortField{
+		"/api/posts":                             {{Field: "createdAt", Desc: true}},
+		"/api/posts?$sortby=-created_at,name":    {{Field: "createdAt", Desc: true}, {Field: "name"}},
+		"/api/posts?$sortby=%2Bname,-created_at": {{Field: "name"}, {Field: "createdAt", Desc: true}},
+	} {
+		fields = nil
+		rec := httptest.NewRecorder()
+		rg.ServeHttp(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusOK || !reflect.DeepEqual(fields, want) {
+			t.Fatalf("%s: status = %d, fields = %+v; want %+v", target, rec.Code, fields, want)
+		}
+	}
+
+	for _, target := range []string{"/api/posts?$sortby=password", "/api/posts?$sortby=name,created_at,name"} {
+		rec := httptest.NewRecorder()
+		rg.ServeHttp(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: status = %d; want 400", target, rec.Code)
+		}
+	}
+}
+
+func TestNewSortHandler_InvalidDefault(t *testing.T) {
+	for _, cfg := range []SortConfig{
+		{Fields: []string{"name"}, Default: "-createdAt"},
+		{Fields: []string{"name", "age"}, Default: "name,age", MaxKeys: 1},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("NewSortHandler(%+v) did not panic", cfg)
+				}
+			}()
+			NewSortHandler(cfg)
+		}()
+	}
+}
+
+func TestServer_SparseFieldsets(t *testing.T) {
+	type owner struct {
+		Email string `json:"email"`
+		Phone string `json:"phone"`
+	}
+	type project struct {
+		Id     int    `json:"id"`
+		Name   string `json:"name"`
+		Secret string `json:"secret"`
+		Owner  owner  `json:"owner"`
+	}
+	rg, _ := newTestRouter(t, "/api")
+	rg.READ("/projects", NewFieldsHandler(FieldsConfig{
+		Allowed: []string{"id", "name", "owner"},
+	}), handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		return []project{{Id: 1, Name: "gear", Secret: "s", Owner: owner{Email: "a@b.c", Phone: "1"}}}, nil
+	}))
+
+	rec := httptest.NewRecorder()
+	rg.ServeHttp(rec, httptest.NewRequest(http.MethodGet, "/api/projects?$fields=id,owner.email", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d; want 200; body=%s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		Items []map[string]any `json:"items"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	want := []map[string]any{{"id": float64(1), "owner": map[string]any{"email": "a@b.c"}}}
+	if !reflect.DeepEqual(resp.Items, want) {
+		t.Fatalf("items = %v; want %v", resp.Items, want)
+	}
+
+	rec = httptest.NewRecorder()
+	rg.ServeHttp(rec, httptest.NewRequest(http.MethodGet, "/api/projects?$fields=id,secret", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d; want 400", rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/projects?$fields=id", nil)
+	req.Header.Set(echo.HeaderAccept, "application/x-protobuf, application/json;q=0.5")
+	rec = httptest.NewRecorder()
+	rg.ServeHttp(rec, req)
+	if ct := rec.Header().Get(echo.HeaderContentType); rec.Code != http.StatusOK || !strings.HasPrefix(ct, echo.MIMEApplicationJSON) {
+		t.Fatalf("status = %d, content type = %q; want a projected json body", rec.Code, ct)
+	}
+
+	rg.READ("/unlisted", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		return project{Id: 1, Secret: "s"}, nil
+	}))
+	rec = httptest.NewRecorder()
+	rg.ServeHttp(rec, httptest.NewRequest(http.MethodGet, "/api/unlisted?$fields=id", nil))
+	if !strings.Contains(rec.Body.String(), `"secret":"s"`) {
+		t.Fatalf("body = %s; want routes without an allowlist left unprojected", rec.Body.String())
+	}
+}
+
+func TestRouterGroup_Envelope(t *testing.T) {
+	var cfg config
+	cfg.Initialize()
+	cfg.Envelope = EnvelopeJSONAPI
+	controller := gateway.NewController(NewResponder(nil), logger.NewSimpleLogger(writers.DebugLevel, logger.JsonEncoding))
+	rg := newRouterGroup(echo.New(), controller, newLiveConfig(cfg), nil, "/api")
+	hal := rg.Group("/hal").(RouterGroup)
+	bare := hal.Group("/bare").(RouterGroup)
+	if err := hal.Envelope(EnvelopeHAL); err != nil {
+		t.Fatalf("Envelope: %v", err)
+	}
+	if err := bare.Envelope(EnvelopeBare); err != nil {
+		t.Fatalf("Envelope: %v", err)
+	}
+	if err := bare.Envelope("nope"); err == nil {
+		t.Fatalf("expected an error for an unknown envelope")
+	}
+	list := handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		req.Paginator().SetTotal(2)
+		return []widget{{Name: "a"}, {Name: "b"}}, nil
+	})
+	single := handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		return widget{Name: "a"}, nil
+	})
+	rg.READ("/widgets", list)
+	hal.READ("/widgets", list)
+	hal.READ("/widget", single)
+	bare.READ("/widgets", list)
+
+	get := func(target string) map[string]any {
+		rec := httptest.NewRecorder()
+		rg.ServeHttp(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		var body any
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: unmarshal: %v; body=%s", target, err, rec.Body.String())
+		}
+		if m, ok := body.(map[string]any); ok {
+			return m
+		}
+		return map[string]any{"bare": body}
+	}
+
+	doc := get("/api/widgets")
+	if meta, _ := doc["meta"].(map[string]any); meta["total"] != float64(2) || meta["request_uuid"] == "" {
+		t.Fatalf("jsonapi = %v", doc)
+	}
+	if data, _ := doc["data"].([]any); len(data) != 2 {
+		t.Fatalf("jsonapi = %v", doc)
+	}
+
+	doc = get("/api/hal/widgets")
+	if embedded, _ := doc["_embedded"].(map[string]any); embedded == nil || doc["_links"] == nil {
+		t.Fatalf("hal = %v", doc)
+	}
+	doc = get("/api/hal/widget")
+	if doc["name"] != "a" || doc["_links"] == nil {
+		t.Fatalf("hal object = %v", doc)
+	}
+
+	if items, _ := get("/api/hal/bare/widgets")["bare"].([]any); len(items) != 2 {
+		t.Fatalf("bare envelope did not return the result as is")
+	}
+}
+
+func TestServer_ConditionalRequests(t *testing.T) {
+	version := 1
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	rg, _ := newTestRouter(t, "/api")
+	rg.READ("/doc", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		return widget{Name: "doc"}, nil
+	}))
+	rg.READ("/versioned", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		req.(Requester).SetETag(fmt.Sprint(version), false)
+		req.(Requester).SetLastModified(modified)
+		return widget{Name: "doc"}, nil
+	}))
+	rg.UPDATE("/versioned", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		if err := req.(Requester).CheckPreconditions(fmt.Sprint(version), modified); err != nil {
+			return nil, err
+		}
+		version++
+		return widget{Name: "doc"}, nil
+	}))
+
+	do := func(method, target string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(`{}`))
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		rg.ServeHttp(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodGet, "/api/doc", nil)
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf("status = %d, ETag = %q", rec.Code, etag)
+	}
+	if rec = do(http.MethodGet, "/api/doc", map[string]string{"If-None-Match": etag}); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Fatalf("If-None-Match: status = %d; want 304", rec.Code)
+	}
+
+	rec = do(http.MethodGet, "/api/versioned", nil)
+	if rec.Header().Get("ETag") != `"1"` || rec.Header().Get("Last-Modified") != modified.Format(http.TimeFormat) {
+		t.Fatalf("ETag = %q, Last-Modified = %q", rec.Header().Get("ETag"), rec.Header().Get("Last-Modified"))
+	}
+	if rec = do(http.MethodGet, "/api/versioned", map[string]string{"If-Modified-Since": modified.Format(http.TimeFormat)}); rec.Code != http.StatusNotModified {
+		t.Fatalf("If-Modified-Since: status = %d; want 304", rec.Code)
+	}
+
+	if rec = do(http.MethodPut, "/api/versioned", map[string]string{"If-Match": `"1"`}); rec.Code != http.StatusCreated {
+		t.Fatalf("If-Match current: status = %d; want 201", rec.Code)
+	}
+	if rec = do(http.MethodPut, "/api/versioned", map[string]string{"If-Match": `"1"`}); rec.Code != http.StatusPreconditionFailed ||
+		!strings.Contains(rec.Body.String(), `"precondition_failed"`) {
+		t.Fatalf("If-Match stale: status = %d, body = %s; want 412 precondition_failed", rec.Code, rec.Body.String())
+	}
+	if rec = do(http.MethodPut, "/api/versioned", map[string]string{"If-Unmodified-Since": modified.Add(-time.Hour).Format(http.TimeFormat)}); rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("If-Unmodified-Since: status = %d; want 412", rec.Code)
+	}
+}
+
+func TestServer_ConditionalRequestsEnvelope(t *testing.T) {
+	for _, name := range []string{EnvelopeJSONAPI, EnvelopeHAL} {
+		rg, _ := newTestRouter(t, "/api")
+		if err := rg.(RouterGroup).Envelope(name); err != nil {
+			t.Fatalf("Envelope(%s): %v", name, err)
+		}
+		rg.READ("/docs", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+			return []widget{{Name: "doc"}}, nil
+		}))
+
+		rec := httptest.NewRecorder()
+		rg.ServeHttp(rec, httptest.NewRequest(http.MethodGet, "/api/docs", nil))
+		etag := rec.Header().Get("ETag")
+		if rec.Code != http.StatusOK || etag == "" || !strings.Contains(rec.Body.String(), "request_uuid") {
+			t.Fatalf("%s: status = %d, ETag = %q, body = %s", name, rec.Code, etag, rec.Body.String())
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/api/docs", nil)
+		req.Header.Set("If-None-Match", etag)
+		rec = httptest.NewRecorder()
+		rg.ServeHttp(rec, req)
+		if rec.Code != http.StatusNotModified {
+			t.Fatalf("%s: If-None-Match: status = %d; want 304", name, rec.Code)
+		}
+	}
+}
+
+func TestRouterGroup_Cache(t *testing.T) {
+	var calls int
+	var callsMtx sync.Mutex
+	rg, _ := newTestRouter(t, "/api")
+	store := NewMemoryCacheStore(8)
+	if err := rg.(RouterGroup).Cache(CacheConfig{
+		Store:                store,
+		TTL:                  time.Minute,
+		StaleWhileRevalidate: time.Minute,
+		Query:                []string{"q"},
+	}); err != nil {
+		t.Fatalf("Cache: %v", err)
+	}
+	rg.READ("/catalog", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		callsMtx.Lock()
+		calls++
+		callsMtx.Unlock()
+		CacheTags(req, "catalog")
+		return []widget{{Name: req.GetQuery("q")}}, nil
+	}))
+	rg.UPDATE("/catalog", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		if err := InvalidateCacheTags(req, "catalog"); err != nil {
+			return nil, errors.HandleError(err)
+		}
+		return nil, nil
+	}))
+
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		rg.ServeHttp(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+	getCalls := func() int {
+		callsMtx.Lock()
+		defer callsMtx.Unlock()
+		return calls
+	}
+
+	first := get("/api/catalog?q=a&ignored=1")
+	if first.Header().Get("X-Cache") != "MISS" || !strings.HasPrefix(first.Header().Get("Cache-Control"), "public, max-age=60") {
+		t.Fatalf("first: X-Cache = %q, Cache-Control = %q", first.Header().Get("X-Cache"), first.Header().Get("Cache-Control"))
+	}
+	second := get("/api/catalog?ignored=2&q=a")
+	if second.Header().Get("X-Cache") != "HIT" || second.Body.String() != first.Body.String() || getCalls() != 1 {
+		t.Fatalf("second: X-Cache = %q, calls = %d", second.Header().Get("X-Cache"), getCalls())
+	}
+	if get("/api/catalog?q=b").Header().Get("X-Cache") != "MISS" || getCalls() != 2 {
+		t.Fatalf("a different q should miss")
+	}
+
+	rec := httptest.NewRecorder()
+	rg.ServeHttp(rec, httptest.NewRequest(http.MethodPut, "/api/catalog", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("invalidate: status = %d", rec.Code)
+	}
+	if get("/api/catalog?q=a").Header().Get("X-Cache") != "MISS" || getCalls() != 3 {
+		t.Fatalf("tag invalidation did not drop the entry")
+	}
+
+	// Expire the entry so it is served stale and refreshed in the background.
+	var expired bool
+	for _, el := range store.(*memoryCacheStore).items {
+		if entry := el.Value.(*memoryCacheItem).entry; strings.Contains(string(entry.Body), `"a"`) {
+			entry.Expires = time.Now().Add(-time.Second)
+			expired = true
+		}
+	}
+	if !expired {
+		t.Fatalf("entry not stored")
+	}
+	if get("/api/catalog?q=a").Header().Get("X-Cache") != "STALE" {
+		t.Fatalf("expected a stale response")
+	}
+	deadline := time.Now().Add(time.Second)
+	for getCalls() != 4 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if getCalls() != 4 {
+		t.Fatalf("stale entry was not revalidated")
+	}
+}
+
+func TestRouterGroup_CacheEntrySize(t *testing.T) {
+	rg, _ := newTestRouter(t, "/api")
+	if err := rg.(RouterGroup).Cache(CacheConfig{TTL: time.Minute, MaxEntrySize: 256}); err != nil {
+		t.Fatalf("Cache: %v", err)
+	}
+	rg.READ("/small", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		return widget{Name: "small"}, nil
+	}))
+	rg.READ("/large", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		return widget{Name: strings.Repeat("x", 512)}, nil
+	}))
+	rg.READ("/stream", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		res := req.GetHttpContext().(echo.Context).Response()
+		res.Header().Set("Content-Type", echo.MIMETextPlain)
+		res.WriteHeader(http.StatusOK)
+		res.Write([]byte("chunk"))
+		res.Flush()
+		req.SetIsResponded(true)
+		return nil, nil
+	}))
+
+	for target, want := range map[string]string{"/api/small": "HIT", "/api/large": "MISS", "/api/stream": "MISS"} {
+		for i := 0; i < 2; i++ {
+			rec := httptest.NewRecorder()
+			rg.ServeHttp(rec, httptest.NewRequest(http.MethodGet, target, nil))
+			if i == 1 && rec.Header().Get("X-Cache") != want {
+				t.Fatalf("%s: X-Cache = %q; want %s", target, rec.Header().Get("X-Cache"), want)
+			}
+		}
+	}
+}
+
+func TestRouterGroup_CacheAuthenticated(t *testing.T) {
+	var calls int
+	rg, _ := newTestRouter(t, "/api")
+	if err := rg.(RouterGroup).Envelope(EnvelopeJSONAPI); err != nil {
+		t.Fatalf("Envelope: %v", err)
+	}
+	if err := rg.(RouterGroup).Cache(CacheConfig{TTL: time.Minute, SessionCookies: []string{"sid"}}); err != nil {
+		t.Fatalf("Cache: %v", err)
+	}
+	rg.READ("/me", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		calls++
+		return widget{Name: "me"}, nil
+	}))
+
+	do := func(method string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/me", nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		rg.ServeHttp(rec, req)
+		return rec
+	}
+
+	for _, header := range []map[string]string{{"Authorization": "Bearer a"}, {"Cookie": "sid=1"}} {
+		for i := 0; i < 2; i++ {
+			rec := do(http.MethodGet, header)
+			if rec.Header().Get("X-Cache") != "BYPASS" || strings.Contains(rec.Header().Get("Cache-Control"), "public") {
+				t.Fatalf("%v: X-Cache = %q, Cache-Control = %q", header, rec.Header().Get("X-Cache"), rec.Header().Get("Cache-Control"))
+			}
+		}
+	}
+	if calls != 4 {
+		t.Fatalf("calls = %d; want 4", calls)
+	}
+
+	first := do(http.MethodGet, map[string]string{"Cookie": "theme=dark"})
+	if first.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("unrelated cookie: X-Cache = %q; want MISS", first.Header().Get("X-Cache"))
+	}
+	if rec := do(http.MethodHead, nil); rec.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("HEAD: X-Cache = %q; want MISS", rec.Header().Get("X-Cache"))
+	}
+	second := do(http.MethodGet, nil)
+	uid := second.Header().Get("X-Request-Uuid")
+	if second.Header().Get("X-Cache") != "HIT" || uid != first.Header().Get("X-Request-Uuid") || !strings.Contains(second.Body.String(), uid) {
+		t.Fatalf("hit: X-Cache = %q, X-Request-Uuid = %q, body = %s", second.Header().Get("X-Cache"), uid, second.Body.String())
+	}
+}
+
+func TestServer_Compression(t *testing.T) {
+	var cfg config
+	cfg.Initialize()
+	cfg.Compression.Enabled = true
+	cfg.Compression.MinSize = 256
+	live := newLiveConfig(cfg)
+	e := echo.New()
+	e.Use(compressionMiddleware(live))
+	controller := gateway.NewController(NewResponder(nil), logger.NewSimpleLogger(writers.DebugLevel, logger.JsonEncoding))
+	rg := newRouterGroup(e, controller, live, nil, "/api")
+
+	large := handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		items := make([]widget, 100)
+		for i := range items {
+			items[i].Name = fmt.Sprintf("widget-%d", i)
+		}
+		return items, nil
+	})
+	rg.READ("/large", large)
+	rg.READ("/plain", NoCompression, large)
+	rg.READ("/small", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		return widget{Name: "small"}, nil
+	}))
+
+	get := func(target, acceptEncoding string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set(echo.HeaderAcceptEncoding, acceptEncoding)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		rg.ServeHttp(rec, req)
+		return rec
+	}
+
+	rec := get("/api/large", "deflate;q=0.5, gzip")
+	if rec.Code != http.StatusOK || rec.Header().Get(echo.HeaderContentEncoding) != "gzip" {
+		t.Fatalf("status = %d, Content-Encoding = %q", rec.Code, rec.Header().Get(echo.HeaderContentEncoding))
+	}
+	if !strings.Contains(rec.Header().Get(echo.HeaderVary), echo.HeaderAcceptEncoding) {
+		t.Fatalf("Vary = %q", rec.Header().Get(echo.HeaderVary))
+	}
+	if etag := rec.Header().Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		t.Fatalf("compressed ETag %q is not weak", etag)
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil || !bytes.Contains(body, []byte("widget-99")) {
+		t.Fatalf("decompressed body = %s, err = %v", body, err)
+	}
+
+	if got := get("/api/large", "gzip;q=0, deflate").Header().Get(echo.HeaderContentEncoding); got != "deflate" {
+		t.Fatalf("Content-Encoding = %q; want deflate", got)
+	}
+	for _, tc := range []struct {
+		name           string
+		target         string
+		acceptEncoding string
+		header         []string
+	}{
+		{"identity", "/api/large", "identity", nil},
+		{"small body", "/api/small", "gzip", nil},
+		{"opt-out", "/api/plain", "gzip", nil},
+		{"upgrade", "/api/large", "gzip", []string{echo.HeaderConnection, "Upgrade", echo.HeaderUpgrade, "websocket"}},
+	} {
+		rec := get(tc.target, tc.acceptEncoding, tc.header...)
+		if rec.Code != http.StatusOK || rec.Header().Get(echo.HeaderContentEncoding) != "" || !json.Valid(rec.Body.Bytes()) {
+			t.Fatalf("%s: status = %d, Content-Encoding = %q", tc.name, rec.Code, rec.Header().Get(echo.HeaderContentEncoding))
+		}
+	}
+
+	for encoding, decode := range map[string]func(io.Reader) (io.Reader, error){
+		"br": func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+		"zstd": func(r io.Reader) (io.Reader, error) {
+			return zstd.NewReader(r)
+		},
+	} {
+		rec := get("/api/large", encoding+", gzip;q=0.5")
+		if rec.Header().Get(echo.HeaderContentEncoding) != encoding {
+			t.Fatalf("Content-Encoding = %q; want %s", rec.Header().Get(echo.HeaderContentEncoding), encoding)
+		}
+		zr, err := decode(rec.Body)
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		body, err := io.ReadAll(zr)
+		if err != nil || !bytes.Contains(body, []byte("widget-99")) {
+			t.Fatalf("%s: decompressed body = %s, err = %v", encoding, body, err)
+		}
+	}
+
+	if got := negotiateEncoding("compress, *;q=0.1", []string{"compress", "gzip"}); got != "gzip" {
+		t.Fatalf("unregistered compress negotiated: %q", got)
+	}
+}
+
+func TestServer_CompressionCacheAndETags(t *testing.T) {
+	var cfg config
+	cfg.Initialize()
+	cfg.Compression.Enabled = true
+	cfg.Compression.MinSize = 256
+	live := newLiveConfig(cfg)
+	e := echo.New()
+	e.Use(compressionMiddleware(live))
+	controller := gateway.NewController(NewResponder(nil), logger.NewSimpleLogger(writers.DebugLevel, logger.JsonEncoding))
+	rg := newRouterGroup(e, controller, live, nil, "/api")
+	if err := rg.Cache(CacheConfig{TTL: time.Minute}); err != nil {
+		t.Fatalf("Cache: %v", err)
+	}
+	rg.READ("/large", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		req.(Requester).SetETag("v1", false)
+		items := make([]widget, 100)
+		for i := range items {
+			items[i].Name = fmt.Sprintf("widget-%d", i)
+		}
+		return items, nil
+	}))
+	rg.UPDATE("/large", handlerFunc(func(req gateway.HttpRequester) (any, errors.ErrorModel) {
+		return nil, req.(Requester).CheckPreconditions("v1", time.Time{})
+	}))
+
+	do := func(method string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/large", nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, want := range []string{"MISS", "HIT"} {
+		rec := do(http.MethodGet, echo.HeaderAcceptEncoding, "gzip")
+		if rec.Header().Get("X-Cache") != want || rec.Header().Get(echo.HeaderContentEncoding) != "gzip" || rec.Header().Get("ETag") != `"v1-gzip"` {
+			t.Fatalf("%s: X-Cache = %q, Content-Encoding = %q, ETag = %q", want, rec.Header().Get("X-Cache"),
+				rec.Header().Get(echo.HeaderContentEncoding), rec.Header().Get("ETag"))
+		}
+		zr, err := gzip.NewReader(rec.Body)
+		if err != nil {
+			t.Fatalf("%s: gzip: %v", want, err)
+		}
+		if body, err := io.ReadAll(zr); err != nil || !bytes.Contains(body, []byte("widget-99")) {
+			t.Fatalf("%s: decompressed body = %s, err = %v", want, body, err)
+		}
+	}
+	rec := do(http.MethodGet)
+	if rec.Header().Get("X-Cache") != "HIT" || rec.Header().Get(echo.HeaderContentEncoding) != "" || !json.Valid(rec.Body.Bytes()) {
+		t.Fatalf("identity hit: X-Cache = %q, Content-Encoding = %q", rec.Header().Get("X-Cache"), rec.Header().Get(echo.HeaderContentEncoding))
+	}
+	if rec := do(http.MethodGet, echo.HeaderAcceptEncoding, "gzip", "If-None-Match", `"v1-gzip"`); rec.Code != http.StatusNotModified {
+		t.Fatalf("If-None-Match: status = %d; want 304", rec.Code)
+	}
+	if rec := do(http.MethodPut, "If-Match", `"v1-gzip"`); rec.Code == http.StatusPreconditionFailed {
+		t.Fatalf("If-Match with the compressed tag: status = %d", rec.Code)
+	}
+	if rec := do(http.MethodPut, "If-Match", `"v0-gzip"`); rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("If-Match stale: status = %d; want 412", rec.Code)
+	}
+}
+
+func TestConfig_CompressionLevel(t *testing.T) {
+	for level, valid := range map[int]bool{0: true, 1: true, 9: true, -1: false, 10: false} {
+		c := config{Http: Http{Compression: CompressionConfig{Level: level}}}
+		c.Initialize()
+		if err := c.validate(); (err == nil) != valid {
+			t.Fatalf("level %d: validate() = %v; want valid %v", level, err, valid)
+		}
+	}
+}
+
+func TestConfig_MetricsPath(t *testing.T) {
+	c := config{Http: Http{Metrics: MetricsConfig{Path: "metrics"}}}
+	c.Initialize()
+	if c.Metrics.Path != "/metrics" {
+		t.Fatalf("path = %q; want /metrics", c.Metrics.Path)
+	}
+}
+
+func TestConfigureHttpServer(t *testing.T) {
+	var defaults config
+	defaults.Initialize()
+	s := &http.Server{}
+	configureHttpServer(s, defaults.Http)
+	if s.ReadTimeout != 0 || s.ReadHeaderTimeout != 30*time.Second || s.WriteTimeout != 0 ||
+		s.IdleTimeout != 30*time.Second || s.MaxHeaderBytes != 0 {
+		t.Fatalf("defaults: read = %v, read header = %v, write = %v, idle = %v, max header bytes = %d",
+			s.ReadTimeout, s.ReadHeaderTimeout, s.WriteTimeout, s.IdleTimeout, s.MaxHeaderBytes)
+	}
+
+	configured := config{Http: Http{
+		ReadTimeout:       5 * time.Second,
+		ReadHeaderTimeout: 2 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		IdleTimeout:       time.Minute,
+		MaxHeaderBytes:    1 << 16,
+	}}
+	configured.Initialize()
+	s = &http.Server{}
+	configureHttpServer(s, configured.Http)
+	if s.ReadTimeout != 5*time.Second || s.ReadHeaderTimeout != 2*time.Second || s.WriteTimeout != 10*time.Second ||
+		s.IdleTimeout != time.Minute || s.MaxHeaderBytes != 1<<16 {
+		t.Fatalf("configured: read = %v, read header = %v, write = %v, idle = %v, max header bytes = %d",
+			s.ReadTimeout, s.ReadHeaderTimeout, s.WriteTimeout, s.IdleTimeout, s.MaxHeaderBytes)
+	}
+}
+
+func TestConfig_CursorSecret(t *testing.T) {
+	for secret, valid := range map[string]bool{"": true, "short": false, "0123456789abcdef": true} {
+		c := config{Http: Http{Pagination: PaginationConfig{CursorSecret: secret}}}
+		c.Initialize()
+		if err := c.validate(); (err == nil) != valid {
+			t.Fatalf("secret %q: validate() = %v; want valid %v", secret, err, valid)
+		}
+	}
+}
+
+func selfSignedPEM(t *testing.T) (certPEM, keyPEM string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "echoserver test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	certPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	keyPEM = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	return certPEM, keyPEM
+}
+
+func TestBuildTLSConfig(t *testing.T) {
+	cert, key := selfSignedPEM(t)
+	_, otherKey := selfSignedPEM(t)
+
+	cfg, err := buildTLSConfig(TLSConfig{
+		Cert:         cert,
+		Key:          key,
+		MinVersion:   "1.3",
+		CipherSuites: []string{"tls_ecdhe_ecdsa_with_aes_128_gcm_sha256"},
+		ClientCA:     cert,
+		ClientAuth:   "require",
+	})
+	if err != nil {
+		t.Fatalf("buildTLSConfig: %v", err)
+	}
+	if len(cfg.Certificates) != 1 || cfg.MinVersion != tls.VersionTLS13 || cfg.ClientCAs == nil ||
+		cfg.ClientAuth != tls.RequireAndVerifyClientCert ||
+		!reflect.DeepEqual(cfg.CipherSuites, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}) {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+
+	cfg, err = buildTLSConfig(TLSConfig{Cert: cert, Key: key})
+	if err != nil || cfg.MinVersion != tls.VersionTLS12 || cfg.ClientAuth != tls.NoClientCert {
+		t.Fatalf("defaults: %+v, %v", cfg, err)
+	}
+
+	for name, c := range map[string]TLSConfig{
+		"missing cert":         {Key: key},
+		"missing cert file":    {CertFile: "/nonexistent/cert.pem", Key: key},
+		"mismatched key":       {Cert: cert, Key: otherKey},
+		"unknown version":      {Cert: cert, Key: key, MinVersion: "2.0"},
+		"unknown cipher suite": {Cert: cert, Key: key, CipherSuites: []string{"TLS_NOPE"}},
+		"unknown client auth":  {Cert: cert, Key: key, ClientAuth: "sometimes"},
+		"verify without ca":    {Cert: cert, Key: key, ClientAuth: "require-and-verify"},
+		"empty ca bundle":      {Cert: cert, Key: key, ClientCA: "not a pem block"},
+	} {
+		if _, err := buildTLSConfig(c); err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestParseTLSHelpers(t *testing.T) {
+	for in, want := range map[string]uint16{
+		"1.0": tls.VersionTLS10, "TLS11": tls.VersionTLS11, "tls1.2": tls.VersionTLS12, "13": tls.VersionTLS13,
+	} {
+		if got, err := parseTLSVersion(in); err != nil || got != want {
+			t.Fatalf("parseTLSVersion(%q) = %x, %v; want %x", in, got, err, want)
+		}
+	}
+	for in, want := range map[string]tls.ClientAuthType{
+		"":                   tls.NoClientCert,
+		"none":               tls.NoClientCert,
+		"request":            tls.RequestClientCert,
+		"require":            tls.RequireAndVerifyClientCert,
+		"verify-if-given":    tls.VerifyClientCertIfGiven,
+		"Require-And-Verify": tls.RequireAndVerifyClientCert,
+	} {
+		if got, err := parseClientAuth(in); err != nil || got != want {
+			t.Fatalf("parseClientAuth(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	ids, err := parseCipherSuites([]string{"TLS_AES_128_GCM_SHA256", "tls_rsa_with_aes_128_cbc_sha"})
+	if err != nil || !reflect.DeepEqual(ids, []uint16{tls.TLS_AES_128_GCM_SHA256, tls.TLS_RSA_WITH_AES_128_CBC_SHA}) {
+		t.Fatalf("parseCipherSuites = %v, %v", ids, err)
+	}
+}
+
+type watchedRegistry struct {
+	mtx      sync.Mutex
+	cfg      config
+	onChange func()
+}
+
+func (r *watchedRegistry) Unmarshal(v any) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	*v.(*config) = r.cfg
+	return nil
+}
+
+func (r *watchedRegistry) ValueOf(string) configer.Registry { return r }
+
+func (r *watchedRegistry) OnChange(fn func()) { r.onChange = fn }
+
+func TestServer_SubscribesToConfigChanges(t *testing.T) {
+	var cfg config
+	cfg.Initialize()
+	reg := &watchedRegistry{cfg: cfg}
+	es := NewTestServer(nil).(*echoServer)
+	es.live.current.Store(&cfg)
+	es.configRegistry = reg
+	es.reloader.cors = newSwappableMiddleware(corsMiddlewareFromConfig(cfg.Http))
+	es.subscribeConfig(reg, es.stop)
+	if reg.onChange == nil {
+		t.Fatalf("server did not subscribe to the registry")
+	}
+
+	reg.mtx.Lock()
+	reg.cfg.WriteTimeout = time.Second
+	reg.mtx.Unlock()
+	reg.onChange()
+	if got := es.live.Load().WriteTimeout; got != time.Second {
+		t.Fatalf("WriteTimeout = %v after a change; want 1s", got)
+	}
+}
+
+func TestHotReloader_AppliesTimeouts(t *testing.T) {
+	var cfg config
+	cfg.Initialize()
+	hr := &hotReloader{live: newLiveConfig(cfg)}
+	e := echo.New()
+	e.Use(hr.applyTimeouts)
+	e.GET("/slow", func(c echo.Context) error {
+		time.Sleep(100 * time.Millisecond)
+		return c.String(http.StatusOK, strings.Repeat("x", 1<<20))
+	})
+	ts := httptest.NewServer(e)
+	defer ts.Close()
+	hr.serving.Store(ts.Config)
+
+	get := func() error {
+		res, err := ts.Client().Get(ts.URL + "/slow")
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		_, err = io.ReadAll(res.Body)
+		return err
+	}
+	if err := get(); err != nil {
+		t.Fatalf("before reload: %v", err)
+	}
+	next := cfg
+	next.WriteTimeout = 10 * time.Millisecond
+	hr.live.current.Store(&next)
+	if err := get(); err == nil {
+		t.Fatalf("expected the reloaded write timeout to cut the response")
+	}
+}
+
+func TestServer_AdminEndpoints(t *testing.T) {
+	es := NewTestServer(nil).(*echoServer)
+	es.admin = newAdminServer()
+	es.mountAdmin(es.admin)
+	es.mountHealth(es.monitoringEngine(), "/monitoring/health")
+
+	get := func(e *echo.Echo, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+	for _, target := range []string{"/runtime", "/debug/pprof/", "/debug/pprof/cmdline", "/monitoring/health/live"} {
+		if rec := get(es.admin, target); rec.Code != http.StatusOK {
+			t.Fatalf("admin %s: status = %d", target, rec.Code)
+		}
+		if rec := get(es.server, target); rec.Code != http.StatusNotFound {
+			t.Fatalf("public %s: status = %d; want 404", target, rec.Code)
+		}
+	}
+	var info runtimeInfo
+	if err := json.Unmarshal(get(es.admin, "/runtime").Body.Bytes(), &info); err != nil || info.GoVersion == "" {
+		t.Fatalf("runtime info = %+v, %v", info, err)
+	}
+
+	noPprof := NewTestServer(nil).(*echoServer)
+	noPprof.live.Load().Admin.DisablePprof = true
+	noPprof.admin = newAdminServer()
+	noPprof.mountAdmin(noPprof.admin)
+	if rec := get(noPprof.admin, "/debug/pprof/"); rec.Code != http.StatusNotFound {
+		t.Fatalf("pprof mounted although disabled: status = %d", rec.Code)
+	}
+}
+
+func TestServer_AdminBindFailure(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer taken.Close()
+
+	es := NewTestServer(nil).(*echoServer)
+	es.live.Load().Admin.Address = taken.Addr().String()
+	es.admin = newAdminServer()
+	done := make(chan error, 1)
+	go func() { done <- es.Run("127.0.0.1:0") }()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "admin listener") {
+			t.Fatalf("Run = %v; want the admin bind error", err)
+		}
+	case <-time.After(2 * time.Second):
+		_ = es.server.Close()
+		t.Fatalf("Run kept serving without its admin listener")
+	}
+}
+
+func TestServer_AdminClosedWhenStartFails(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer taken.Close()
+
+	es := NewTestServer(nil).(*echoServer)
+	es.live.Load().Admin.Address = "127.0.0.1:0"
+	es.admin = newAdminServer()
+	if err := es.Run(taken.Addr().String()); err == nil {
+		t.Fatalf("Run = nil; want the bind error of the main listener")
+	}
+	if conn, err := net.Dial("tcp", es.admin.Listener.Addr().String()); err == nil {
+		conn.Close()
+		t.Fatalf("admin listener still accepts connections")
+	}
+}
@@ -0,0 +1,156 @@
+package echoserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+const connTrackerContextKey = "_echoserver.conn_tracker"
+
+type shutdownHook struct {
+	name    string
+	hook    func(ctx context.Context) error
+	timeout time.Duration
+}
+
+// connTracker keeps the websocket connections hijacked from the server, which
+// http.Server.Shutdown does not wait for.
+type connTracker struct {
+	mtx   sync.Mutex
+	conns map[*echoWebSocket]struct{}
+	empty chan struct{}
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[*echoWebSocket]struct{})}
+}
+
+func (t *connTracker) add(ws *echoWebSocket) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.conns[ws] = struct{}{}
+}
+
+func (t *connTracker) remove(ws *echoWebSocket) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	delete(t.conns, ws)
+	if len(t.conns) == 0 && t.empty != nil {
+		close(t.empty)
+		t.empty = nil
+	}
+}
+
+// closeAll sends a going away close frame to every connection and waits for
+// the handlers to close them, closing the rest forcefully when ctx is done.
+func (t *connTracker) closeAll(ctx context.Context) {
+	t.mtx.Lock()
+	if len(t.conns) == 0 {
+		t.mtx.Unlock()
+		return
+	}
+	empty := make(chan struct{})
+	t.empty = empty
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is shutting down")
+	deadline := time.Now().Add(time.Second)
+	for ws := range t.conns {
+		_ = ws.conn.WriteControl(websocket.CloseMessage, msg, deadline)
+	}
+	t.mtx.Unlock()
+
+	select {
+	case <-empty:
+	case <-ctx.Done():
+		t.mtx.Lock()
+		for ws := range t.conns {
+			_ = ws.conn.Close()
+			delete(t.conns, ws)
+		}
+		t.empty = nil
+		t.mtx.Unlock()
+	}
+}
+
+func injectConnTracker(t *connTracker) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set(connTrackerContextKey, t)
+			return next(c)
+		}
+	}
+}
+
+func getConnTracker(c echo.Context) *connTracker {
+	if t, ok := c.Get(connTrackerContextKey).(*connTracker); ok {
+		return t
+	}
+	return nil
+}
+
+func (es *echoServer) OnShutdown(name string, hook func(ctx context.Context) error, timeout ...time.Duration) {
+	h := shutdownHook{name: name, hook: hook, timeout: es.live.Load().Shutdown.HookTimeout}
+	if len(timeout) > 0 {
+		h.timeout = timeout[0]
+	}
+	es.hooksMtx.Lock()
+	defer es.hooksMtx.Unlock()
+	es.hooks = append(es.hooks, h)
+}
+
+func (es *echoServer) Shutdown(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	es.ready.Store(false)
+	if delay := es.live.Load().Shutdown.DrainDelay; delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+	}
+	es.stopOnce.Do(func() { close(es.stop) })
+
+	var errs []error
+	if err := es.server.Shutdown(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	es.conns.closeAll(ctx)
+	if es.admin != nil {
+		if err := es.admin.Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	es.hooksMtx.Lock()
+	hooks := append([]shutdownHook(nil), es.hooks...)
+	es.hooksMtx.Unlock()
+	for _, h := range hooks {
+		if err := runShutdownHook(h); err != nil {
+			errs = append(errs, fmt.Errorf("shutdown hook %s: %v", h.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func runShutdownHook(h shutdownHook) error {
+	ctx := context.Background()
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+	done := make(chan error, 1)
+	go func() { done <- h.hook(ctx) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,142 @@
+package echoserver
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/aliworkshop/errors"
+	"github.com/aliworkshop/gateway/v2"
+)
+
+const sortFieldsKey = "_echoserver.sort_fields"
+
+// SortField is a single key of a sort, e.g. -created_at.
+type SortField struct {
+	Field string
+	Desc  bool
+}
+
+// ParseSort reads a comma separated list of sort keys. A leading - sorts the
+// key in descending order and a leading + in ascending order.
+func ParseSort(s string) []SortField {
+	var fields []SortField
+	for _, key := range strings.Split(s, ",") {
+		key = strings.TrimSpace(key)
+		var desc bool
+		switch {
+		case strings.HasPrefix(key, "-"):
+			desc, key = true, key[1:]
+		case strings.HasPrefix(key, "+"):
+			key = key[1:]
+		}
+		if key != "" {
+			fields = append(fields, SortField{Field: key, Desc: desc})
+		}
+	}
+	return fields
+}
+
+// FormatSort is the inverse of ParseSort.
+func FormatSort(fields []SortField) string {
+	keys := make([]string, len(fields))
+	for i, f := range fields {
+		keys[i] = f.Field
+		if f.Desc {
+			keys[i] = "-" + f.Field
+		}
+	}
+	return strings.Join(keys, ",")
+}
+
+// SortConfig configures the sorting of a route.
+type SortConfig struct {
+	// Fields are the keys clients may sort on.
+	Fields []string
+	// Columns maps keys to the names handed to the sorter, the key itself
+	// by default.
+	Columns map[string]string
+	// Default is the sort used when the request has no $sortby.
+	Default string
+	// MaxKeys bounds the number of keys of a sort, unbounded when zero.
+	MaxKeys int
+}
+
+type sortHandler struct {
+	cfg      SortConfig
+	defaults []SortField
+}
+
+// NewSortHandler returns a handler checking the $sortby query parameter of
+// requests against the allowed fields and setting the sorter of the request
+// to the resulting multi key sort, e.g. $sortby=-created_at,name. It panics
+// when the default sort is not allowed by the config, as that is a mistake of
+// the route rather than of its clients.
+func NewSortHandler(cfg SortConfig) gateway.Handler {
+	defaults := ParseSort(cfg.Default)
+	if err := validateDefaultSort(cfg, defaults); err != nil {
+		panic(err)
+	}
+	return &sortHandler{cfg: cfg, defaults: defaults}
+}
+
+func validateDefaultSort(cfg SortConfig, defaults []SortField) error {
+	if cfg.MaxKeys > 0 && len(defaults) > cfg.MaxKeys {
+		return fmt.Errorf("sort: default %q has more than %d keys", cfg.Default, cfg.MaxKeys)
+	}
+	for _, f := range defaults {
+		if !slices.Contains(cfg.Fields, f.Field) {
+			return fmt.Errorf("sort: default key %s is not one of the fields %v", f.Field, cfg.Fields)
+		}
+	}
+	return nil
+}
+
+func (h *sortHandler) Handle(req gateway.HttpRequester) (any, errors.ErrorModel) {
+	fields := ParseSort(req.GetQuery("$sortby"))
+	if len(fields) == 0 {
+		fields = h.defaults
+	}
+	if h.cfg.MaxKeys > 0 && len(fields) > h.cfg.MaxKeys {
+		err := fmt.Errorf("$sortby accepts at most %d keys", h.cfg.MaxKeys)
+		return nil, errors.Validation(err).WithProperty("error", err.Error())
+	}
+
+	sorted := make([]SortField, 0, len(fields))
+	var fieldErrors []FieldError
+	seen := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		if !slices.Contains(h.cfg.Fields, f.Field) {
+			fieldErrors = append(fieldErrors, FieldError{
+				Field:   "$sortby",
+				Tag:     "sort",
+				Param:   f.Field,
+				Message: fmt.Sprintf("sorting on %s is not allowed", f.Field),
+			})
+			continue
+		}
+		if seen[f.Field] {
+			continue
+		}
+		seen[f.Field] = true
+		if column, ok := h.cfg.Columns[f.Field]; ok {
+			f.Field = column
+		}
+		sorted = append(sorted, f)
+	}
+	if len(fieldErrors) > 0 {
+		err := fmt.Errorf("invalid sort")
+		return nil, errors.Validation(err).WithProperty("error", err.Error()).WithProperty("fields", fieldErrors)
+	}
+
+	req.SetKey(sortFieldsKey, sorted)
+	req.Sorter().SetSort(FormatSort(sorted))
+	return nil, nil
+}
+
+// SortFields returns the sort checked by the sort handler of the route.
+func SortFields(req gateway.HttpRequester) []SortField {
+	v, _ := req.GetKey(sortFieldsKey)
+	fields, _ := v.([]SortField)
+	return fields
+}
@@ -1,23 +1,64 @@
 package echoserver
 
 import (
-	"github.com/aliworkshop/gateway/v2"
 	"net/http"
+	"sync"
+
+	"github.com/aliworkshop/errors"
+	"github.com/aliworkshop/gateway/v2"
+)
+
+// Statuses and error types for http codes gateway and errors have no value
+// for. Their values are the codes they map to, above the small ranges of
+// gateway.Status and errors.Type. Handlers pass the statuses to Respond and
+// create errors of the types with NewTypedError.
+const (
+	StatusAccepted       gateway.Status = http.StatusAccepted
+	StatusPartialContent gateway.Status = http.StatusPartialContent
+	StatusNotModified    gateway.Status = http.StatusNotModified
+
+	TypeMethodNotAllowed     errors.Type = http.StatusMethodNotAllowed
+	TypeRequestTimeout       errors.Type = http.StatusRequestTimeout
+	TypeGone                 errors.Type = http.StatusGone
+	TypePreconditionFailed   errors.Type = http.StatusPreconditionFailed
+	TypeRequestTooLarge      errors.Type = http.StatusRequestEntityTooLarge
+	TypeUnsupportedMediaType errors.Type = http.StatusUnsupportedMediaType
+	TypeUnprocessable        errors.Type = http.StatusUnprocessableEntity
+	TypeLocked               errors.Type = http.StatusLocked
+	TypeFailedDependency     errors.Type = http.StatusFailedDependency
+	TypeUnavailable          errors.Type = http.StatusServiceUnavailable
+	TypeTimeout              errors.Type = http.StatusGatewayTimeout
+)
+
+var (
+	statusMap = map[gateway.Status]int{
+		gateway.StatusOK:                http.StatusOK,
+		gateway.StatusCreated:           http.StatusCreated,
+		gateway.StatusNoContent:         http.StatusNoContent,
+		gateway.StatusMovedPermanently:  http.StatusMovedPermanently,
+		gateway.StatusFound:             http.StatusFound,
+		gateway.StatusPermanentRedirect: http.StatusPermanentRedirect,
+		gateway.StatusTemporaryRedirect: http.StatusTemporaryRedirect,
+		gateway.StatusBadInput:          http.StatusBadRequest,
+		gateway.StatusConflict:          http.StatusConflict,
+		StatusAccepted:                  http.StatusAccepted,
+		StatusPartialContent:            http.StatusPartialContent,
+		StatusNotModified:               http.StatusNotModified,
+	}
+	statusMapMtx sync.RWMutex
 )
 
-var statusMap = map[gateway.Status]int{
-	gateway.StatusOK:                http.StatusOK,
-	gateway.StatusCreated:           http.StatusCreated,
-	gateway.StatusNoContent:         http.StatusNoContent,
-	gateway.StatusMovedPermanently:  http.StatusMovedPermanently,
-	gateway.StatusFound:             http.StatusFound,
-	gateway.StatusPermanentRedirect: http.StatusPermanentRedirect,
-	gateway.StatusTemporaryRedirect: http.StatusTemporaryRedirect,
-	gateway.StatusBadInput:          http.StatusBadRequest,
-	gateway.StatusConflict:          http.StatusConflict,
+// RegisterStatusCode maps a gateway status to an http status code. It
+// overrides the built-in mapping of the status, if any.
+func RegisterStatusCode(status gateway.Status, code int) {
+	statusMapMtx.Lock()
+	defer statusMapMtx.Unlock()
+	statusMap[status] = code
 }
 
 func getStatusCode(status gateway.Status) int {
+	statusMapMtx.RLock()
+	defer statusMapMtx.RUnlock()
 	if code, ok := statusMap[status]; ok {
 		return code
 	}
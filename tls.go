@@ -0,0 +1,134 @@
+package echoserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type TLSConfig struct {
+	Enabled bool
+	// CertFile and KeyFile are paths of PEM encoded files, Cert and Key hold
+	// the PEM blocks themselves. Files take precedence.
+	CertFile     string
+	KeyFile      string
+	Cert         string
+	Key          string
+	MinVersion   string
+	CipherSuites []string
+	// ClientCAFile and ClientCA hold the CA bundle client certificates are
+	// verified against.
+	ClientCAFile string
+	ClientCA     string
+	// ClientAuth is one of none, request, require, verify-if-given and
+	// require-and-verify. require is an alias of require-and-verify, so the
+	// client certificate is always verified when one is demanded.
+	ClientAuth string
+}
+
+func buildTLSConfig(c TLSConfig) (*tls.Config, error) {
+	cert, err := readPEM(c.CertFile, c.Cert)
+	if err != nil {
+		return nil, err
+	}
+	key, err := readPEM(c.KeyFile, c.Key)
+	if err != nil {
+		return nil, err
+	}
+	pair, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		return nil, fmt.Errorf("tls: invalid key pair: %v", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.MinVersion != "" {
+		if cfg.MinVersion, err = parseTLSVersion(c.MinVersion); err != nil {
+			return nil, err
+		}
+	}
+	if len(c.CipherSuites) > 0 {
+		if cfg.CipherSuites, err = parseCipherSuites(c.CipherSuites); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.ClientAuth, err = parseClientAuth(c.ClientAuth); err != nil {
+		return nil, err
+	}
+	if c.ClientCAFile != "" || c.ClientCA != "" {
+		ca, err := readPEM(c.ClientCAFile, c.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("tls: no certificate found in client ca bundle")
+		}
+		cfg.ClientCAs = pool
+	}
+	if cfg.ClientAuth >= tls.VerifyClientCertIfGiven && cfg.ClientCAs == nil {
+		return nil, fmt.Errorf("tls: client auth %s needs a client ca bundle", c.ClientAuth)
+	}
+	return cfg, nil
+}
+
+func readPEM(file, content string) ([]byte, error) {
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %v", err)
+		}
+		return b, nil
+	}
+	if content == "" {
+		return nil, fmt.Errorf("tls: neither a file nor a pem block is set")
+	}
+	return []byte(content), nil
+}
+
+func parseTLSVersion(v string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(v), "tls") {
+	case "1.0", "10":
+		return tls.VersionTLS10, nil
+	case "1.1", "11":
+		return tls.VersionTLS11, nil
+	case "1.2", "12":
+		return tls.VersionTLS12, nil
+	case "1.3", "13":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("tls: unknown version %s", v)
+}
+
+func parseCipherSuites(names []string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[cs.Name] = cs.ID
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("tls: unknown cipher suite %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func parseClientAuth(s string) (tls.ClientAuthType, error) {
+	switch strings.ToLower(s) {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.RequestClientCert, nil
+	case "verify-if-given":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require", "require-and-verify":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return 0, fmt.Errorf("tls: unknown client auth %s", s)
+}
@@ -0,0 +1,146 @@
+package echoserver
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+)
+
+// ValidationRule describes a validation tag. A rule either validates with
+// Func, expands to the tags of Alias, or only documents and translates a tag
+// that already exists.
+type ValidationRule struct {
+	Tag   string
+	Func  validator.Func
+	Alias string
+	// CallEvenIfNull runs Func for nil values as well.
+	CallEvenIfNull bool
+	// MessageID is the i18n message id overriding the message of the tag,
+	// validation.<tag> by default.
+	MessageID string
+	// Message is the default message of the tag. {0} is replaced with the
+	// field name and {1} with the param of the tag.
+	Message string
+	// Translations holds the message of the tag per locale, e.g. fa.
+	Translations map[string]string
+	Description  string
+}
+
+var slugRegex = regexp.MustCompile(`^[a-z0-9]+(?:-[a-z0-9]+)*$`)
+
+var builtinValidationRules = []ValidationRule{
+	{
+		Tag: "slug",
+		Func: func(fl validator.FieldLevel) bool {
+			return slugRegex.MatchString(fl.Field().String())
+		},
+		Message:      "{0} must be a valid slug",
+		Translations: map[string]string{"fa": "{0} باید یک slug معتبر باشد"},
+		Description:  "lowercase letters and digits separated by single hyphens",
+	},
+	{
+		Tag:          "phone",
+		Alias:        "e164",
+		Message:      "{0} must be a valid E.164 formatted phone number",
+		Translations: map[string]string{"fa": "{0} باید یک شماره تلفن معتبر با فرمت E.164 باشد"},
+		Description:  "phone number in E.164 format, e.g. +989121234567",
+	},
+	{
+		Tag:         "e164",
+		Description: "phone number in E.164 format, e.g. +989121234567",
+	},
+	{
+		Tag:         "ulid",
+		Description: "universally unique lexicographically sortable identifier",
+	},
+	{
+		Tag:          "iso4217",
+		Message:      "{0} must be a valid ISO 4217 currency code",
+		Translations: map[string]string{"fa": "{0} باید یک کد ارز معتبر ISO 4217 باشد"},
+		Description:  "ISO 4217 currency code, e.g. USD",
+	},
+	{
+		Tag:          "timezone",
+		Message:      "{0} must be a valid time zone",
+		Translations: map[string]string{"fa": "{0} باید یک منطقه زمانی معتبر باشد"},
+		Description:  "IANA time zone name, e.g. Asia/Tehran",
+	},
+}
+
+func (vl *validation) register(rule ValidationRule) error {
+	if rule.Tag == "" {
+		return fmt.Errorf("validation rule without a tag")
+	}
+	if rule.Func != nil && rule.Alias != "" {
+		return fmt.Errorf("validation rule %s: both Func and Alias are set", rule.Tag)
+	}
+
+	vl.mtx.Lock()
+	defer vl.mtx.Unlock()
+	switch {
+	case rule.Func != nil:
+		if err := vl.validate.RegisterValidation(rule.Tag, rule.Func, rule.CallEvenIfNull); err != nil {
+			return fmt.Errorf("validation rule %s: %v", rule.Tag, err)
+		}
+	case rule.Alias != "":
+		vl.validate.RegisterAlias(rule.Tag, rule.Alias)
+	}
+	for locale := range defaultTranslations {
+		message, ok := rule.Translations[locale]
+		if !ok {
+			message = rule.Message
+		}
+		if message == "" {
+			continue
+		}
+		trans, _ := vl.translator.GetTranslator(locale)
+		if err := vl.validate.RegisterTranslation(rule.Tag, trans, func(trans ut.Translator) error {
+			return trans.Add(rule.Tag, message, true)
+		}, translateFieldError); err != nil {
+			return fmt.Errorf("validation rule %s: %v", rule.Tag, err)
+		}
+	}
+	vl.rules[rule.Tag] = rule
+	return nil
+}
+
+func translateFieldError(trans ut.Translator, fe validator.FieldError) string {
+	msg, err := trans.T(fe.Tag(), fe.Field(), fe.Param())
+	if err != nil {
+		return fe.Error()
+	}
+	return msg
+}
+
+func (es *echoServer) RegisterValidation(rule ValidationRule) error {
+	if es.started.Load() {
+		return fmt.Errorf("validation rule %s: server is already running", rule.Tag)
+	}
+	return es.validation.register(rule)
+}
+
+func (es *echoServer) RegisterStructValidation(fn validator.StructLevelFunc, types ...any) error {
+	if es.started.Load() {
+		return fmt.Errorf("struct validation: server is already running")
+	}
+	es.validation.mtx.Lock()
+	defer es.validation.mtx.Unlock()
+	es.validation.validate.RegisterStructValidation(fn, types...)
+	return nil
+}
+
+func (es *echoServer) ValidationRules() []ValidationRule {
+	es.validation.mtx.RLock()
+	defer es.validation.mtx.RUnlock()
+	rules := make([]ValidationRule, 0, len(es.validation.rules))
+	for _, rule := range es.validation.rules {
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Tag < rules[j].Tag
+	})
+	return rules
+}
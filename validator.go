@@ -1,11 +1,37 @@
 package echoserver
 
 import (
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/aliworkshop/errors"
+	"github.com/aliworkshop/gateway/v2"
+	"github.com/go-playground/locales/ar"
+	"github.com/go-playground/locales/en"
+	"github.com/go-playground/locales/fa"
+	ut "github.com/go-playground/universal-translator"
 	"github.com/go-playground/validator/v10"
+	arTranslations "github.com/go-playground/validator/v10/translations/ar"
+	enTranslations "github.com/go-playground/validator/v10/translations/en"
+	faTranslations "github.com/go-playground/validator/v10/translations/fa"
 	"github.com/labstack/echo/v4"
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+)
+
+const (
+	validatorContextKey  = "_echoserver.validator"
+	validationContextKey = "_echoserver.validation"
 )
 
-const validatorContextKey = "_echoserver.validator"
+// FieldError describes a single failed validation rule. Field is the path of
+// the field built from its json names, e.g. address.street or items[0].name.
+type FieldError struct {
+	Field   string `json:"field"`
+	Tag     string `json:"tag"`
+	Param   string `json:"param,omitempty"`
+	Message string `json:"message"`
+}
 
 type customValidator struct {
 	validator *validator.Validate
@@ -15,10 +41,54 @@ func (cv *customValidator) Validate(i any) error {
 	return cv.validator.Struct(i)
 }
 
-func injectValidator(v *validator.Validate) echo.MiddlewareFunc {
+// defaultTranslations registers the messages of the baked-in validation tags
+// for each supported locale.
+var defaultTranslations = map[string]func(*validator.Validate, ut.Translator) error{
+	"en": enTranslations.RegisterDefaultTranslations,
+	"fa": faTranslations.RegisterDefaultTranslations,
+	"ar": arTranslations.RegisterDefaultTranslations,
+}
+
+// validation holds the validator of a server together with the translator of
+// its messages and the rules registered on top of the baked-in ones.
+type validation struct {
+	validate   *validator.Validate
+	translator *ut.UniversalTranslator
+	mtx        sync.RWMutex
+	rules      map[string]ValidationRule
+}
+
+// newValidation returns a validator along with a translator holding the
+// default messages of its rules.
+func newValidation() *validation {
+	v := validator.New()
+
+	uni := ut.New(en.New(), en.New(), fa.New(), ar.New())
+	for locale, register := range defaultTranslations {
+		trans, _ := uni.GetTranslator(locale)
+		if err := register(v, trans); err != nil {
+			panic(err)
+		}
+	}
+
+	vl := &validation{
+		validate:   v,
+		translator: uni,
+		rules:      make(map[string]ValidationRule),
+	}
+	for _, rule := range builtinValidationRules {
+		if err := vl.register(rule); err != nil {
+			panic(err)
+		}
+	}
+	return vl
+}
+
+func injectValidator(vl *validation) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
-			c.Set(validatorContextKey, v)
+			c.Set(validatorContextKey, vl.validate)
+			c.Set(validationContextKey, vl)
 			return next(c)
 		}
 	}
@@ -30,3 +100,146 @@ func getValidator(c echo.Context) *validator.Validate {
 	}
 	return validator.New()
 }
+
+// getTranslator picks the translator matching the Accept-Language header of
+// the request, falling back to english.
+func getTranslator(c echo.Context) ut.Translator {
+	vl, ok := c.Get(validationContextKey).(*validation)
+	if !ok {
+		return nil
+	}
+	var locales []string
+	for _, part := range strings.Split(c.Request().Header.Get("Accept-Language"), ",") {
+		tag, _, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.ReplaceAll(strings.ToLower(tag), "-", "_")
+		if tag == "" {
+			continue
+		}
+		locales = append(locales, tag)
+		if base, _, ok := strings.Cut(tag, "_"); ok {
+			locales = append(locales, base)
+		}
+	}
+	trans, _ := vl.translator.FindTranslator(locales...)
+	return trans
+}
+
+// messageID returns the i18n message id of a validation tag.
+func messageID(c echo.Context, tag string) string {
+	if vl, ok := c.Get(validationContextKey).(*validation); ok {
+		vl.mtx.RLock()
+		rule, ok := vl.rules[tag]
+		vl.mtx.RUnlock()
+		if ok && rule.MessageID != "" {
+			return rule.MessageID
+		}
+	}
+	return "validation." + tag
+}
+
+// ValidationError converts err, usually the result of validating a struct, to
+// a validation error. Failed rules of validator.ValidationErrors are listed
+// in the fields property with messages localized for the request. Bundle
+// messages with the MessageID of the rule, validation.<tag> by default,
+// override the built-in messages. When the validated struct is given, fields
+// are named by their json path in it, otherwise by their Go path.
+func ValidationError(req gateway.HttpRequester, err error, validated ...any) errors.ErrorModel {
+	result := errors.Validation(err).WithProperty("error", err.Error())
+	verrs, ok := err.(validator.ValidationErrors)
+	if !ok {
+		return result
+	}
+	ctx := req.GetHttpContext().(echo.Context)
+	trans := getTranslator(ctx)
+	var root reflect.Type
+	if len(validated) > 0 && validated[0] != nil {
+		root = reflect.TypeOf(validated[0])
+	}
+	fields := make([]FieldError, 0, len(verrs))
+	for _, fe := range verrs {
+		field := FieldError{
+			Field: fieldPath(fe.Namespace()),
+			Tag:   fe.Tag(),
+			Param: fe.Param(),
+		}
+		if trans != nil {
+			field.Message = fe.Translate(trans)
+		} else {
+			field.Message = fe.Error()
+		}
+		if root != nil {
+			field.Field = jsonFieldPath(root, fe.StructNamespace())
+			leaf := field.Field[strings.LastIndexByte(field.Field, '.')+1:]
+			field.Message = strings.Replace(field.Message, fe.Field(), leaf, 1)
+		}
+		if language := req.GetLanguage(); language != nil {
+			msg, err := language.Localize(&i18n.LocalizeConfig{
+				DefaultMessage: &i18n.Message{
+					ID:    messageID(ctx, fe.Tag()),
+					Other: field.Message,
+				},
+				TemplateData: map[string]any{
+					"Field": field.Field,
+					"Param": field.Param,
+				},
+			})
+			if err == nil {
+				field.Message = msg
+			}
+		}
+		fields = append(fields, field)
+	}
+	return result.WithProperty("fields", fields)
+}
+
+// jsonFieldPath turns the struct namespace of a failed field, e.g.
+// Form.Address.Street, into its path in the json encoding of root,
+// address.street.
+func jsonFieldPath(root reflect.Type, namespace string) string {
+	_, path, ok := strings.Cut(namespace, ".")
+	if !ok {
+		return namespace
+	}
+	t := root
+	var parts []string
+	for _, name := range strings.Split(path, ".") {
+		name, index, _ := strings.Cut(name, "[")
+		if index != "" {
+			index = "[" + index
+		}
+		for t != nil && t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		var f reflect.StructField
+		found := false
+		if t != nil && t.Kind() == reflect.Struct {
+			f, found = t.FieldByName(name)
+		}
+		if !found {
+			parts = append(parts, name+index)
+			t = nil
+			continue
+		}
+		if jsonName, _, _ := strings.Cut(f.Tag.Get("json"), ","); jsonName != "" && jsonName != "-" {
+			parts = append(parts, jsonName+index)
+		} else if !f.Anonymous {
+			parts = append(parts, name+index)
+		}
+		t = f.Type
+		for index != "" && t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		if index != "" && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array || t.Kind() == reflect.Map) {
+			t = t.Elem()
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// fieldPath drops the name of the root struct from a validator namespace.
+func fieldPath(namespace string) string {
+	if _, path, ok := strings.Cut(namespace, "."); ok {
+		return path
+	}
+	return namespace
+}
@@ -12,7 +12,8 @@ import (
 )
 
 type echoWebSocket struct {
-	conn *websocket.Conn
+	conn    *websocket.Conn
+	tracker *connTracker
 }
 
 func (ew *echoWebSocket) Read(_ context.Context) (int, []byte, error) {
@@ -28,6 +29,9 @@ func (ew *echoWebSocket) WriteJson(_ context.Context, msg any) error {
 }
 
 func (ew *echoWebSocket) Close() {
+	if ew.tracker != nil {
+		ew.tracker.remove(ew)
+	}
 	if err := ew.conn.Close(); err != nil {
 		fmt.Println("in close handler", err)
 	}
@@ -52,5 +56,9 @@ func upgrade(c echo.Context) (gateway.WebSocketHandler, error) {
 		fmt.Println("connection initialization error", err)
 		return nil, err
 	}
-	return &echoWebSocket{conn: conn}, nil
+	ws := &echoWebSocket{conn: conn, tracker: getConnTracker(c)}
+	if ws.tracker != nil {
+		ws.tracker.add(ws)
+	}
+	return ws, nil
 }